@@ -1,30 +1,42 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"net"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/orches-team/orches/pkg/git"
 	"github.com/orches-team/orches/pkg/syncer"
+	"github.com/orches-team/orches/pkg/utils"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
 const version = "0.1.1-dev"
 
 var baseDir string
 
+// gitBackend selects the implementation of git.Repo, it is set by the
+// --git-backend flag. Empty means the backend the repository was cloned with,
+// and cli for new clones.
+var gitBackend string
+
 func init() {
 	if _, err := os.Stat("/run/.containerenv"); err == nil {
 		baseDir = "/var/lib/orches"
@@ -38,15 +50,25 @@ func init() {
 	} else {
 		baseDir = "/var/lib/orches"
 	}
+
+	syncer.RepoDir = filepath.Join(baseDir, "repo")
 }
 
 type rootFlags struct {
-	dryRun bool
+	dryRun        bool
+	healthTimeout time.Duration
+	output        string
 }
 
 type daemonCommand struct {
-	Name string `json:"name"`
-	Arg  string `json:"arg"`
+	Name   string `json:"name"`
+	Arg    string `json:"arg"`
+	Ref    string `json:"ref,omitempty"`
+	Depth  int    `json:"depth,omitempty"`
+	Filter string `json:"filter,omitempty"`
+	Output string `json:"output"`
+
+	Credentials git.Credentials `json:"credentials"`
 }
 
 func handleConnection(sock net.Listener, cmdChan chan<- daemonCommand, resultChan <-chan string) error {
@@ -95,7 +117,92 @@ func waitForCommands(sock net.Listener) (<-chan daemonCommand, chan<- string) {
 
 func getRootFlags(cmd *cobra.Command) rootFlags {
 	dryRun, _ := cmd.Flags().GetBool("dry")
-	return rootFlags{dryRun: dryRun}
+	healthTimeout, _ := cmd.Flags().GetDuration("health-timeout")
+	output, _ := cmd.Flags().GetString("output")
+	return rootFlags{dryRun: dryRun, healthTimeout: healthTimeout, output: output}
+}
+
+func addCloneFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("depth", 0, "Clone and fetch only the given number of commits, 0 clones the full history")
+	cmd.Flags().String("filter", "", "Partial clone filter (e.g. blob:none), requires the cli git backend")
+
+	cmd.Flags().String("ssh-key", "", "Private SSH key to authenticate to the remote with")
+	cmd.Flags().String("known-hosts", "", "known_hosts file with the only accepted host keys of the remote")
+	addTokenFlags(cmd)
+}
+
+// addTokenFlags adds the flags of the HTTPS token sources, they are shared
+// with the git credential helper.
+func addTokenFlags(cmd *cobra.Command) {
+	cmd.Flags().String("token-file", "", "File with an HTTPS token to authenticate to the remote with")
+	cmd.Flags().String("token-credential", "", "Name of a systemd credential with an HTTPS token")
+	cmd.Flags().String("github-app-id", "", "ID of a GitHub App to request installation tokens for")
+	cmd.Flags().String("github-app-installation-id", "", "Installation ID of the GitHub App")
+	cmd.Flags().String("github-app-key", "", "Private key of the GitHub App")
+}
+
+func getCloneOptions(cmd *cobra.Command) (git.CloneOptions, error) {
+	depth, _ := cmd.Flags().GetInt("depth")
+	filter, _ := cmd.Flags().GetString("filter")
+
+	creds, err := getCredentials(cmd)
+	if err != nil {
+		return git.CloneOptions{}, err
+	}
+
+	return git.CloneOptions{Depth: depth, Filter: filter, Credentials: creds}, nil
+}
+
+// getCredentials reads the credential flags of cmd, flags it does not have
+// are left empty.
+func getCredentials(cmd *cobra.Command) (git.Credentials, error) {
+	var creds git.Credentials
+	for flag, value := range map[string]*string{
+		"ssh-key":                    &creds.SSHKey,
+		"known-hosts":                &creds.KnownHosts,
+		"token-file":                 &creds.TokenFile,
+		"token-credential":           &creds.TokenCredential,
+		"github-app-id":              &creds.GitHubAppID,
+		"github-app-installation-id": &creds.GitHubAppInstallationID,
+		"github-app-key":             &creds.GitHubAppKey,
+	} {
+		if f := cmd.Flags().Lookup(flag); f != nil {
+			*value = f.Value.String()
+		}
+	}
+
+	// absolute paths are important for the daemon
+	for _, p := range []*string{&creds.SSHKey, &creds.KnownHosts, &creds.TokenFile, &creds.GitHubAppKey} {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return git.Credentials{}, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+		*p = abs
+	}
+
+	return creds, nil
+}
+
+var outputFormats = []string{"text", "json", "yaml"}
+
+// formatOutput renders v in the given output format. The text format is
+// produced by the text function.
+func formatOutput(format string, v any, text func() string) (string, error) {
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(v, "", "  ")
+		return string(out), err
+	case "yaml":
+		out, err := yaml.Marshal(v)
+		return strings.TrimSuffix(string(out), "\n"), err
+	case "text":
+		return text(), nil
+	default:
+		return "", fmt.Errorf("unknown output format: %s", format)
+	}
 }
 
 func socketPath() string {
@@ -143,7 +250,7 @@ func main() {
 		Short:   "A simple git-ops tool for Podman and systemd",
 		Long:    "orches is a git-ops tool for orchestrating Podman containers and systemd units on a single machine.",
 		Version: version,
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			level := slog.LevelInfo
 			verbose, _ := cmd.Flags().GetBool("verbose")
 			if verbose {
@@ -159,44 +266,109 @@ func main() {
 
 			slog.Debug("Base directory", "path", baseDir)
 			slog.Debug("uid", "uid", os.Getuid())
+
+			if output := getRootFlags(cmd).output; !slices.Contains(outputFormats, output) {
+				return fmt.Errorf("unknown output format %s, expected one of %v", output, outputFormats)
+			}
+			if gitBackend != "" && !slices.Contains(git.Backends, gitBackend) {
+				return fmt.Errorf("unknown git backend %s, expected one of %v", gitBackend, git.Backends)
+			}
+			return nil
 		},
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
 	rootCmd.PersistentFlags().Bool("dry", false, "Dry run")
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
+	rootCmd.PersistentFlags().StringP("output", "o", "text", "Output format of status, diff and sync: text, json or yaml")
+	rootCmd.PersistentFlags().Duration("health-timeout", 0, "How long to wait for started units to become healthy, 0 disables health checks")
+	rootCmd.PersistentFlags().StringVar(&gitBackend, "git-backend", "", "Git implementation: cli runs the git binary, go is built into orches. Defaults to the backend the repository was cloned with, or cli")
 
 	var initCmd = &cobra.Command{
 		Use:   "init [remote]",
 		Short: "Initialize by cloning a repo and setting up state",
 		Long:  "Initialize orches by cloning a Git repository and setting up the initial deployment state. The remote argument can be any valid Git repository URL or local path.",
 		Example: "  orches init https://github.com/user/repo.git\n" +
-			"  orches init /path/to/local/repo",
+			"  orches init /path/to/local/repo\n" +
+			"  orches init --ref 'v*' https://github.com/user/repo.git\n" +
+			"  orches init --depth 1 --filter blob:none https://github.com/user/repo.git\n" +
+			"  orches init --ssh-key /etc/orches/id_ed25519 --known-hosts /etc/orches/known_hosts git@github.com:user/repo.git\n" +
+			"  orches init --token-credential git-token https://github.com/user/repo.git",
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if socketExists() {
 				return errors.New("daemon is already running, cannot init")
 			}
-			return initRepo(args[0], getRootFlags(cmd))
+
+			var adopt adoptFunc
+			if a, _ := cmd.Flags().GetBool("adopt"); a {
+				yes, _ := cmd.Flags().GetBool("yes")
+				adopt = confirmAdoption(yes)
+			}
+			ref, _ := cmd.Flags().GetString("ref")
+			opts, err := getCloneOptions(cmd)
+			if err != nil {
+				return err
+			}
+			return initRepo(args[0], ref, opts, getRootFlags(cmd), adopt)
 		},
 	}
 
+	initCmd.Flags().String("ref", "", "Branch, tag, commit, or tag glob (e.g. v*) to deploy instead of the default branch")
+	addCloneFlags(initCmd)
+
+	initCmd.Flags().Bool("adopt", false, "Take ownership of existing unit files that the repository also defines")
+	initCmd.Flags().BoolP("yes", "y", false, "Adopt existing unit files without asking for a confirmation")
+
+	var adoptCmd = &cobra.Command{
+		Use:   "adopt",
+		Short: "Take ownership of existing unit files",
+		Long:  "Take ownership of existing unit files that orches did not create, but that the target repository defines, and sync them. Shows how the files differ from the repository, and asks for a confirmation first.",
+		Example: "  orches adopt\n" +
+			"  orches adopt --yes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if socketExists() {
+				return errors.New("daemon is running, stop it before adopting units")
+			}
+
+			if _, err := os.Stat(path.Join(baseDir, "repo")); errors.Is(err, os.ErrNotExist) {
+				return errors.New("no repository found, initalize orches first")
+			}
+
+			yes, _ := cmd.Flags().GetBool("yes")
+			return cmdAdopt(getRootFlags(cmd), confirmAdoption(yes))
+		},
+	}
+
+	adoptCmd.Flags().BoolP("yes", "y", false, "Adopt existing unit files without asking for a confirmation")
+
 	var syncCmd = &cobra.Command{
 		Use:   "sync",
 		Short: "Sync deployments",
 		Long:  "Synchronize the local system state with the target repository's state. This will fetch the latest changes and apply them.",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			dc := daemonCommand{Name: "sync"}
+			flags := getRootFlags(cmd)
+			dc := daemonCommand{Name: "sync", Output: flags.output}
 			remoteRes, err := sendMessageToDaemon(dc)
 			if err != nil {
 				return fmt.Errorf("failed to send message to daemon: %w", err)
 			}
-			if remoteRes != "" {
+			if remoteRes != "" && flags.output != "text" {
+				fmt.Println(remoteRes)
+				return nil
+			} else if remoteRes != "" {
 				fmt.Fprintf(os.Stderr, "Daemon responded: %s\n", remoteRes)
 				return nil
 			}
 
-			_, err = cmdSync(getRootFlags(cmd))
+			res, err := cmdSync(flags)
+			if res != nil && flags.output != "text" {
+				out, fmtErr := formatOutput(flags.output, res, nil)
+				if fmtErr != nil {
+					return errors.Join(err, fmtErr)
+				}
+				fmt.Println(out)
+			}
 			return err
 		},
 	}
@@ -224,7 +396,9 @@ func main() {
 		Short: "Switch to a different deployment",
 		Long:  "Switch the deployment source to a different Git repository. This will first prune the existing deployment and then initialize from the new source.",
 		Example: "  orches switch https://github.com/user/new-repo.git\n" +
-			"  orches switch /path/to/new/local/repo",
+			"  orches switch /path/to/new/local/repo\n" +
+			"  orches switch --ref 'v*' https://github.com/user/new-repo.git\n" +
+			"  orches switch --depth 1 https://github.com/user/new-repo.git",
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			p := args[0]
@@ -238,7 +412,12 @@ func main() {
 				}
 			}
 
-			dc := daemonCommand{Name: "switch", Arg: p}
+			ref, _ := cmd.Flags().GetString("ref")
+			opts, err := getCloneOptions(cmd)
+			if err != nil {
+				return err
+			}
+			dc := daemonCommand{Name: "switch", Arg: p, Ref: ref, Depth: opts.Depth, Filter: opts.Filter, Credentials: opts.Credentials}
 			remoteRes, err := sendMessageToDaemon(dc)
 			if err != nil {
 				return fmt.Errorf("failed to send message to daemon: %w", err)
@@ -248,21 +427,28 @@ func main() {
 				return nil
 			}
 
-			return cmdSwitch(p, getRootFlags(cmd))
+			return cmdSwitch(p, ref, opts, getRootFlags(cmd))
 		},
 	}
 
+	switchCmd.Flags().String("ref", "", "Branch, tag, commit, or tag glob (e.g. v*) to deploy instead of the default branch")
+	addCloneFlags(switchCmd)
+
 	var statusCmd = &cobra.Command{
 		Use:   "status",
 		Short: "Show the repository status",
 		Long:  "Display information about the current deployment, including the remote repository URL and the currently deployed Git reference.",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			dc := daemonCommand{Name: "status"}
+			flags := getRootFlags(cmd)
+			dc := daemonCommand{Name: "status", Output: flags.output}
 			remoteRes, err := sendMessageToDaemon(dc)
 			if err != nil {
 				return fmt.Errorf("failed to send message to daemon: %w", err)
 			}
-			if remoteRes != "" {
+			if remoteRes != "" && flags.output != "text" {
+				fmt.Println(remoteRes)
+				return nil
+			} else if remoteRes != "" {
 				fmt.Fprintf(os.Stderr, "Daemon responded:\n%s\n", remoteRes)
 				return nil
 			}
@@ -270,7 +456,7 @@ func main() {
 			if _, err := os.Stat(path.Join(baseDir, "repo")); errors.Is(err, os.ErrNotExist) {
 				return errors.New("no repository found, initalize orches first")
 			}
-			result, err := cmdStatus()
+			result, err := cmdStatus(flags.output)
 			if err != nil {
 				return err
 			}
@@ -281,6 +467,31 @@ func main() {
 		},
 	}
 
+	var diffCmd = &cobra.Command{
+		Use:     "diff",
+		Aliases: []string{"plan"},
+		Short:   "Show what the next sync would do",
+		Long:    "Fetch the remote repository and show the changes between the deployed commit and the upstream branch: added, removed and modified units, diffs of modified files, and systemctl actions the next sync would run. Nothing on the system is changed.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := os.Stat(path.Join(baseDir, "repo")); errors.Is(err, os.ErrNotExist) {
+				return errors.New("no repository found, initalize orches first")
+			}
+
+			plan, err := cmdDiff()
+			if err != nil {
+				return err
+			}
+
+			out, err := formatOutput(getRootFlags(cmd).output, plan, plan.String)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(strings.TrimSuffix(out, "\n"))
+			return nil
+		},
+	}
+
 	var runCmd = &cobra.Command{
 		Use:   "run",
 		Short: "Periodically sync deployments",
@@ -293,6 +504,11 @@ func main() {
 				return err
 			}
 
+			reconcile, err := cmd.Flags().GetBool("reconcile")
+			if err != nil {
+				return err
+			}
+
 			if _, err := os.Stat(path.Join(baseDir, "repo")); errors.Is(err, os.ErrNotExist) {
 				return errors.New("no repository found, initalize orches first")
 			}
@@ -320,6 +536,16 @@ func main() {
 					return nil
 				}
 
+				restartNeeded, err := cmdDrift(getRootFlags(cmd), reconcile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error while checking for drift: %v\n", err)
+				}
+
+				if restartNeeded {
+					fmt.Fprintln(os.Stderr, "Restart needed after reconciling drift, exiting.")
+					return nil
+				}
+
 				nextTick := time.After(time.Duration(syncInterval) * time.Second)
 
 			innerLoop:
@@ -332,13 +558,21 @@ func main() {
 						switch c.Name {
 						case "sync":
 							res, err := cmdSync(getRootFlags(cmd))
+							response := "Synced"
 							if err != nil {
-								statusChan <- fmt.Sprintf("%v", err)
+								response = fmt.Sprintf("%v", err)
 								fmt.Fprintf(os.Stderr, "Remote sync command failed: %v\n", err)
 							} else {
-								statusChan <- "Synced"
 								fmt.Fprintln(os.Stderr, "Remote sync command successfully processed.")
 							}
+							if res != nil && c.Output != "" && c.Output != "text" {
+								if out, fmtErr := formatOutput(c.Output, res, nil); fmtErr != nil {
+									response = fmt.Sprintf("%v", fmtErr)
+								} else {
+									response = out
+								}
+							}
+							statusChan <- response
 							if res != nil && res.RestartNeeded {
 								fmt.Fprintln(os.Stderr, "Restart needed after a remote sync, exiting.")
 								return nil
@@ -354,7 +588,8 @@ func main() {
 								return nil
 							}
 						case "switch":
-							err := cmdSwitch(c.Arg, getRootFlags(cmd))
+							opts := git.CloneOptions{Depth: c.Depth, Filter: c.Filter, Credentials: c.Credentials}
+							err := cmdSwitch(c.Arg, c.Ref, opts, getRootFlags(cmd))
 							if err != nil {
 								statusChan <- fmt.Sprintf("%v", err)
 								fmt.Fprintf(os.Stderr, "Remote switch (%s) command failed: %v\n", c.Arg, err)
@@ -364,7 +599,11 @@ func main() {
 								return nil
 							}
 						case "status":
-							res, err := cmdStatus()
+							output := c.Output
+							if output == "" {
+								output = "text"
+							}
+							res, err := cmdStatus(output)
 							if err != nil {
 								statusChan <- fmt.Sprintf("%v", err)
 								fmt.Fprintf(os.Stderr, "Remote status command failed: %v\n", err)
@@ -385,6 +624,7 @@ func main() {
 	}
 
 	runCmd.Flags().Int("interval", 120, "Interval in seconds between synchronization attempts")
+	runCmd.Flags().Bool("reconcile", false, "Restore and restart units whose installed files drifted from the repository")
 
 	var versionCmd = &cobra.Command{
 		Use:   "version",
@@ -423,11 +663,28 @@ func main() {
 		},
 	}
 
+	// git runs it to get the HTTPS token, so the token is never passed to git
+	// in its environment or arguments.
+	var gitCredentialCmd = &cobra.Command{
+		Use:    "git-credential [action]",
+		Short:  "Git credential helper that returns the HTTPS token",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			creds, err := getCredentials(cmd)
+			if err != nil {
+				return err
+			}
+			return git.CredentialHelper(creds, args[0], os.Stdin, os.Stdout)
+		},
+	}
+	addTokenFlags(gitCredentialCmd)
+
 	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
 		return fmt.Errorf("%w\nSee '%s --help'", err, cmd.CommandPath())
 	})
 
-	rootCmd.AddCommand(initCmd, syncCmd, pruneCmd, runCmd, switchCmd, statusCmd, versionCmd)
+	rootCmd.AddCommand(initCmd, adoptCmd, syncCmd, diffCmd, pruneCmd, runCmd, switchCmd, statusCmd, versionCmd, gitCredentialCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -476,22 +733,123 @@ func lock(fn func() error) error {
 	return fn()
 }
 
-func initRepo(remote string, flags rootFlags) error {
+func initRepo(remote, ref string, opts git.CloneOptions, flags rootFlags, adopt adoptFunc) error {
 	return lock(func() error {
-		return doInit(remote, flags.dryRun)
+		return doInit(remote, ref, opts, flags, adopt)
 	})
 }
 
-func doInit(remote string, dryRun bool) error {
+// adoptFunc decides whether orches takes ownership of unmanaged units.
+type adoptFunc func(unmanaged []syncer.UnmanagedUnit) (bool, error)
+
+// confirmAdoption shows how the unmanaged units differ from the repository,
+// and asks the user for a confirmation, unless yes is set.
+func confirmAdoption(yes bool) adoptFunc {
+	return func(unmanaged []syncer.UnmanagedUnit) (bool, error) {
+		for _, u := range unmanaged {
+			if u.Diff == "" {
+				fmt.Fprintf(os.Stderr, "%s is already installed, and is identical to %s\n", u.Name, u.RepoPath)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "%s is already installed, and differs from %s:\n%s\n", u.Name, u.RepoPath, u.Diff)
+		}
+
+		if yes {
+			return true, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Take ownership of %d existing units, and overwrite them? [y/N] ", len(unmanaged))
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, fmt.Errorf("failed to read the answer: %w", err)
+		}
+
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+func unmanagedPaths(unmanaged []syncer.UnmanagedUnit) string {
+	return strings.Join(utils.MapSlice(unmanaged, func(u syncer.UnmanagedUnit) string { return u.Path }), ", ")
+}
+
+// doInit clones the remote, and deploys the given ref. An empty ref means
+// the default branch of the remote.
+func doInit(remote, ref string, opts git.CloneOptions, flags rootFlags, adopt adoptFunc) error {
 	repoPath := filepath.Join(baseDir, "repo")
 
 	if _, err := os.Stat(repoPath); !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("repository already exists at %s", repoPath)
 	}
 
-	if _, err := git.Clone(remote, repoPath); err != nil {
+	repo, err := git.Clone(gitBackend, remote, repoPath, opts)
+	if err != nil {
 		return fmt.Errorf("failed to clone repo: %w", err)
 	}
+	defer repo.Close()
+
+	if ref != "" {
+		if err := repo.SetTargetRef(ref); err != nil {
+			os.RemoveAll(repoPath)
+			return err
+		}
+
+		commit, err := git.ResolveTarget(repo, ref)
+		if err != nil {
+			os.RemoveAll(repoPath)
+			return err
+		}
+
+		if err := repo.Reset(commit); err != nil {
+			os.RemoveAll(repoPath)
+			return fmt.Errorf("failed to reset repository to %s: %w", commit, err)
+		}
+	}
+
+	head, err := repo.Ref("HEAD")
+	if err != nil {
+		os.RemoveAll(repoPath)
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+
+	if err := verifyTarget(repo, "", head, flags.dryRun); err != nil {
+		os.RemoveAll(repoPath)
+		return err
+	}
+
+	tree, err := repo.Tree(head)
+	if err != nil {
+		os.RemoveAll(repoPath)
+		return fmt.Errorf("failed to read tree of %s: %w", head, err)
+	}
+
+	// Existing files must not be overwritten, unless they are adopted.
+	unmanaged, err := syncer.FindUnmanaged(tree, nil)
+	if err != nil {
+		os.RemoveAll(repoPath)
+		return fmt.Errorf("failed to check for existing units: %w", err)
+	}
+
+	var manifest *syncer.Manifest
+	if len(unmanaged) > 0 {
+		if adopt == nil {
+			os.RemoveAll(repoPath)
+			return fmt.Errorf("refusing to overwrite unmanaged unit files: %s. Use orches init --adopt to take ownership of them", unmanagedPaths(unmanaged))
+		}
+
+		ok, err := adopt(unmanaged)
+		if err != nil {
+			os.RemoveAll(repoPath)
+			return err
+		}
+		if !ok {
+			os.RemoveAll(repoPath)
+			return errors.New("adoption cancelled, nothing was changed")
+		}
+
+		manifest = &syncer.Manifest{}
+		manifest.Adopt(unmanaged)
+	}
 
 	blank, err := os.MkdirTemp("", "orches-initial-sync-")
 	if err != nil {
@@ -499,17 +857,22 @@ func doInit(remote string, dryRun bool) error {
 	}
 	defer os.RemoveAll(blank)
 
-	if _, err := syncer.SyncDirs(blank, repoPath, dryRun, nil); err != nil {
+	if _, err := syncer.SyncTrees(os.DirFS(blank), tree, manifest, flags.dryRun, flags.healthTimeout, nil); err != nil {
 		return fmt.Errorf("failed to sync directories: %w", err)
 	}
 
-	if dryRun {
-		if err := os.RemoveAll(baseDir); err != nil {
+	if flags.dryRun {
+		// The base directory also holds the trusted keys, so only the repository is removed.
+		if err := os.RemoveAll(repoPath); err != nil {
 			return fmt.Errorf("failed to remove directory: %w", err)
 		}
 		return nil
 	}
 
+	if err := saveManifest(tree, head); err != nil {
+		return err
+	}
+
 	fmt.Fprintf(os.Stderr, "Initialized repo from %s\n", remote)
 	return nil
 }
@@ -519,7 +882,11 @@ func cmdSync(flags rootFlags) (*syncer.SyncResult, error) {
 
 	err := lock(func() error {
 		repoDir := filepath.Join(baseDir, "repo")
-		repo := git.Repo{Path: repoDir}
+		repo, err := git.Open(gitBackend, repoDir)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
 
 		currentLocalRef, err := repo.Ref("HEAD")
 		if err != nil {
@@ -531,9 +898,14 @@ func cmdSync(flags rootFlags) (*syncer.SyncResult, error) {
 			return fmt.Errorf("failed to fetch from origin: %w", err)
 		}
 
-		remoteUpstreamRef, err := repo.Ref("@{u}")
+		remoteUpstreamRef, err := resolveTarget(repo)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := syncer.LoadManifest(manifestPath())
 		if err != nil {
-			return fmt.Errorf("failed to get upstream ref (@{u}): %w. Ensure your current branch is tracking an upstream branch", err)
+			return err
 		}
 
 		syncPostSyncAction := func(isDryRun bool) error {
@@ -551,37 +923,422 @@ func cmdSync(flags rootFlags) (*syncer.SyncResult, error) {
 
 		if currentLocalRef == remoteUpstreamRef {
 			fmt.Fprintln(os.Stderr, "No new commits to sync.")
+			res = &syncer.SyncResult{From: currentLocalRef, To: remoteUpstreamRef}
+
+			// The target may have been moved back from a refused or rejected commit.
+			if !flags.dryRun {
+				if err := os.Remove(refusalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return fmt.Errorf("failed to remove refusal: %w", err)
+				}
+				if err := repo.SetRejectedCommit(""); err != nil {
+					return err
+				}
+			}
+
+			// Deployments from older versions of orches have no manifest yet.
+			if manifest == nil && !flags.dryRun {
+				tree, err := repo.Tree(currentLocalRef)
+				if err != nil {
+					return fmt.Errorf("failed to read tree of %s: %w", currentLocalRef, err)
+				}
+				return saveManifest(tree, currentLocalRef)
+			}
 			return nil
 		}
 
 		fmt.Fprintf(os.Stderr, "Current HEAD is %s, targeting %s\n", currentLocalRef, remoteUpstreamRef)
 
-		oldState, err := repo.NewWorktree(currentLocalRef)
+		rejected, err := repo.RejectedCommit()
+		if err != nil {
+			return err
+		}
+		if rejected == remoteUpstreamRef {
+			err := fmt.Errorf("refusing to deploy %s, it was rolled back before. Push a new commit to retry", remoteUpstreamRef)
+			res = &syncer.SyncResult{From: currentLocalRef, To: remoteUpstreamRef, Error: err.Error()}
+			return err
+		}
+
+		if err := verifyTarget(repo, currentLocalRef, remoteUpstreamRef, flags.dryRun); err != nil {
+			res = &syncer.SyncResult{From: currentLocalRef, To: remoteUpstreamRef, Error: err.Error()}
+			return err
+		}
+
+		oldTree, err := deployedTree(repo, manifest, currentLocalRef)
 		if err != nil {
-			return fmt.Errorf("failed to create worktree for current state: %w", err)
+			return fmt.Errorf("failed to read tree of current state: %w", err)
 		}
-		defer oldState.Cleanup()
 
-		newState, err := repo.NewWorktree(remoteUpstreamRef)
+		newTree, err := repo.Tree(remoteUpstreamRef)
 		if err != nil {
-			return fmt.Errorf("failed to create worktree for new state: %w", err)
+			return fmt.Errorf("failed to read tree of new state: %w", err)
 		}
-		defer newState.Cleanup()
 
-		fmt.Fprintf(os.Stderr, "Syncing changes between %s and %s\n", currentLocalRef, remoteUpstreamRef)
+		// Deployments from older versions of orches own all units of the deployed commit.
+		if manifest == nil {
+			manifest, err = syncer.NewManifest(oldTree, currentLocalRef)
+			if err != nil {
+				return fmt.Errorf("failed to create manifest: %w", err)
+			}
+		}
 
-		res, err = syncer.SyncDirs(oldState.Path, newState.Path, flags.dryRun, syncPostSyncAction)
+		unmanaged, err := syncer.FindUnmanaged(newTree, manifest)
 		if err != nil {
+			return fmt.Errorf("failed to check for existing units: %w", err)
+		}
+		if len(unmanaged) > 0 {
+			return fmt.Errorf("refusing to overwrite unmanaged unit files: %s. Use orches adopt to take ownership of them", unmanagedPaths(unmanaged))
+		}
+
+		fmt.Fprintf(os.Stderr, "Syncing changes between %s and %s\n", currentLocalRef, remoteUpstreamRef)
+
+		res, err = syncer.SyncTrees(oldTree, newTree, manifest, flags.dryRun, flags.healthTimeout, syncPostSyncAction)
+		if res != nil {
+			res.From = currentLocalRef
+			res.To = remoteUpstreamRef
+		}
+		var partial *syncer.ErrPartialSync
+		if errors.As(err, &partial) && !flags.dryRun {
+			slog.Error("Sync process failed, rolling back", "error", err, "current_ref", currentLocalRef)
+			if rollbackErr := rollback(repo, oldTree, newTree, manifest, currentLocalRef, remoteUpstreamRef, flags.healthTimeout); rollbackErr != nil {
+				return fmt.Errorf("failed to sync directories: %w, rollback to %s failed: %v", err, currentLocalRef, rollbackErr)
+			}
+			return fmt.Errorf("failed to sync directories, rolled back to %s: %w", currentLocalRef, err)
+		} else if err != nil {
 			slog.Error("Sync process failed", "error", err, "current_ref", currentLocalRef)
 			return fmt.Errorf("failed to sync directories: %w", err)
 		}
 
+		if !flags.dryRun {
+			if err := saveManifest(newTree, remoteUpstreamRef); err != nil {
+				return err
+			}
+			if err := repo.SetRejectedCommit(""); err != nil {
+				return err
+			}
+		}
+
 		fmt.Fprintf(os.Stderr, "Synced to %s\n", remoteUpstreamRef)
 		return nil
 	})
 	return res, err
 }
 
+// cmdDrift reports units whose installed files drifted from the deployed
+// commit. With reconcile, it also restores them.
+func cmdDrift(flags rootFlags, reconcile bool) (bool, error) {
+	var restartNeeded bool
+
+	err := lock(func() error {
+		repo, tree, err := openHead(gitBackend, filepath.Join(baseDir, "repo"))
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		var drift map[string]string
+		if reconcile {
+			drift, restartNeeded, err = syncer.Reconcile(tree, flags.dryRun)
+		} else {
+			drift, err = syncer.Drift(tree)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(drift)) {
+			fmt.Fprintf(os.Stderr, "Drift detected in %s: %s\n", name, drift[name])
+		}
+
+		if err != nil {
+			return err
+		}
+		if reconcile && len(drift) > 0 {
+			fmt.Fprintf(os.Stderr, "Restored %d drifted units\n", len(drift))
+		}
+		return nil
+	})
+	return restartNeeded, err
+}
+
+// cmdAdopt takes ownership of units of the upstream commit whose install
+// paths are taken by unmanaged files, and syncs to the upstream commit.
+func cmdAdopt(flags rootFlags, adopt adoptFunc) error {
+	err := lock(func() error {
+		repoDir := filepath.Join(baseDir, "repo")
+		repo, err := git.Open(gitBackend, repoDir)
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		currentLocalRef, err := repo.Ref("HEAD")
+		if err != nil {
+			return fmt.Errorf("failed to get current HEAD ref: %w", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Fetching from origin\n")
+		if err := repo.Fetch("origin"); err != nil {
+			return fmt.Errorf("failed to fetch from origin: %w", err)
+		}
+
+		remoteUpstreamRef, err := resolveTarget(repo)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := syncer.LoadManifest(manifestPath())
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			oldTree, err := repo.Tree(currentLocalRef)
+			if err != nil {
+				return fmt.Errorf("failed to read tree of current state: %w", err)
+			}
+
+			manifest, err = syncer.NewManifest(oldTree, currentLocalRef)
+			if err != nil {
+				return fmt.Errorf("failed to create manifest: %w", err)
+			}
+		}
+
+		newTree, err := repo.Tree(remoteUpstreamRef)
+		if err != nil {
+			return fmt.Errorf("failed to read tree of new state: %w", err)
+		}
+
+		unmanaged, err := syncer.FindUnmanaged(newTree, manifest)
+		if err != nil {
+			return fmt.Errorf("failed to check for existing units: %w", err)
+		}
+		if len(unmanaged) == 0 {
+			fmt.Fprintln(os.Stderr, "No unmanaged units to adopt.")
+			return nil
+		}
+
+		ok, err := adopt(unmanaged)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("adoption cancelled, nothing was changed")
+		}
+
+		if flags.dryRun {
+			fmt.Fprintf(os.Stderr, "Dry run, would adopt %s\n", unmanagedPaths(unmanaged))
+			return nil
+		}
+
+		manifest.Adopt(unmanaged)
+		if err := manifest.Save(manifestPath()); err != nil {
+			return fmt.Errorf("failed to save manifest: %w", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Adopted %s\n", unmanagedPaths(unmanaged))
+		return nil
+	})
+	if err != nil || flags.dryRun {
+		return err
+	}
+
+	_, err = cmdSync(flags)
+	return err
+}
+
+func refusalPath() string {
+	return path.Join(baseDir, "refused")
+}
+
+// verifyTarget verifies signatures of commits in from..to if trusted keys
+// are configured. A refusal is recorded for orches status until a commit is
+// accepted.
+func verifyTarget(repo git.Repo, from, to string, dryRun bool) error {
+	keys, err := git.LoadTrustedKeys(path.Join(baseDir, "trusted-keys"))
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return nil
+	}
+
+	err = repo.VerifyCommits(keys, from, to)
+	var untrusted *git.ErrUntrusted
+	if errors.As(err, &untrusted) {
+		slog.Error("Refusing to deploy untrusted commit", "commit", untrusted.Commit)
+		if !dryRun {
+			if err := os.WriteFile(refusalPath(), []byte(untrusted.Error()), 0644); err != nil {
+				slog.Error("Failed to record the refusal", "error", err)
+			}
+		}
+		return fmt.Errorf("refusing to deploy %s: %w", to, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to verify signatures: %w", err)
+	}
+
+	if !dryRun {
+		if err := os.Remove(refusalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove refusal: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// resolveTarget resolves the ref orches follows to a commit.
+func resolveTarget(repo git.Repo) (string, error) {
+	target, err := repo.TargetRef()
+	if err != nil {
+		return "", err
+	}
+
+	return git.ResolveTarget(repo, target)
+}
+
+func manifestPath() string {
+	return path.Join(baseDir, syncer.ManifestFile)
+}
+
+// saveManifest records the units of the tree as deployed from ref.
+func saveManifest(tree fs.FS, ref string) error {
+	manifest, err := syncer.NewManifest(tree, ref)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+
+	if err := manifest.Save(manifestPath()); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+
+	return nil
+}
+
+// deployedTree returns the tree of the commit recorded in the manifest,
+// which is the last one deployed. If there is no manifest, or the commit is
+// gone, the tree of ref is returned.
+func deployedTree(repo git.Repo, manifest *syncer.Manifest, ref string) (fs.FS, error) {
+	if manifest != nil && manifest.Commit != "" && manifest.Commit != ref {
+		if tree, err := repo.Tree(manifest.Commit); err == nil {
+			return tree, nil
+		}
+		slog.Warn("Deployed commit is not in the repository, using HEAD", "commit", manifest.Commit)
+	}
+
+	return repo.Tree(ref)
+}
+
+// rollback reverts a partially applied sync by syncing from the new state
+// back to the one recorded in manifest, and resetting the repository to the
+// old ref. The new ref is rejected, so it is not deployed again until the
+// target moves.
+func rollback(repo git.Repo, oldTree, newTree fs.FS, manifest *syncer.Manifest, oldRef, newRef string, healthTimeout time.Duration) error {
+	if err := repo.SetRejectedCommit(newRef); err != nil {
+		slog.Error("Failed to record the rejected commit", "error", err)
+	}
+
+	rollbackPostSyncAction := func(isDryRun bool) error {
+		slog.Info("PostSyncAction(rollback): Resetting repository", "ref", oldRef)
+		if err := repo.Reset(oldRef); err != nil {
+			return fmt.Errorf("failed to reset repository to %s: %w", oldRef, err)
+		}
+		return nil
+	}
+
+	if _, err := syncer.Rollback(oldTree, newTree, manifest, healthTimeout, rollbackPostSyncAction); err != nil {
+		return err
+	}
+
+	// Deployments from older versions of orches get the manifest of the old state now.
+	if err := manifest.Save(manifestPath()); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Rolled back to %s\n", oldRef)
+	return nil
+}
+
+func cmdDiff() (*syncer.Plan, error) {
+	var plan *syncer.Plan
+
+	err := lock(func() error {
+		repo, err := git.Open(gitBackend, filepath.Join(baseDir, "repo"))
+		if err != nil {
+			return err
+		}
+		defer repo.Close()
+
+		currentLocalRef, err := repo.Ref("HEAD")
+		if err != nil {
+			return fmt.Errorf("failed to get current HEAD ref: %w", err)
+		}
+
+		fmt.Fprintf(os.Stderr, "Fetching from origin\n")
+		if err := repo.Fetch("origin"); err != nil {
+			return fmt.Errorf("failed to fetch from origin: %w", err)
+		}
+
+		remoteUpstreamRef, err := resolveTarget(repo)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := syncer.LoadManifest(manifestPath())
+		if err != nil {
+			return err
+		}
+
+		oldTree, err := deployedTree(repo, manifest, currentLocalRef)
+		if err != nil {
+			return fmt.Errorf("failed to read tree of current state: %w", err)
+		}
+
+		newTree, err := repo.Tree(remoteUpstreamRef)
+		if err != nil {
+			return fmt.Errorf("failed to read tree of new state: %w", err)
+		}
+
+		plan, err = syncer.PlanTrees(oldTree, newTree, manifest)
+		if err != nil {
+			return err
+		}
+
+		plan.From = currentLocalRef
+		plan.To = remoteUpstreamRef
+
+		// Report what would make a sync refuse the target, the plan is computed regardless.
+		rejected, err := repo.RejectedCommit()
+		if err != nil {
+			return err
+		}
+		switch {
+		case currentLocalRef == remoteUpstreamRef:
+			// Nothing would be deployed.
+		case rejected == remoteUpstreamRef:
+			plan.Refused = fmt.Sprintf("%s was rolled back before. Push a new commit to retry", remoteUpstreamRef)
+		default:
+			err := verifyTarget(repo, currentLocalRef, remoteUpstreamRef, true)
+			var untrusted *git.ErrUntrusted
+			if errors.As(err, &untrusted) {
+				plan.Refused = err.Error()
+			} else if err != nil {
+				return err
+			}
+		}
+
+		// Deployments from older versions of orches own all units of the deployed commit.
+		if manifest == nil {
+			manifest, err = syncer.NewManifest(oldTree, currentLocalRef)
+			if err != nil {
+				return fmt.Errorf("failed to create manifest: %w", err)
+			}
+		}
+
+		plan.Unmanaged, err = syncer.FindUnmanaged(newTree, manifest)
+		if err != nil {
+			return fmt.Errorf("failed to check for existing units: %w", err)
+		}
+		return nil
+	})
+
+	return plan, err
+}
+
 func cmdPrune(flags rootFlags) error {
 	return lock(func() error {
 		return doPrune(flags.dryRun)
@@ -590,8 +1347,10 @@ func cmdPrune(flags rootFlags) error {
 
 func doPrune(dryRun bool) error {
 	repoDir := filepath.Join(baseDir, "repo")
-	if _, err := os.Stat(repoDir); errors.Is(err, os.ErrNotExist) {
-		return errors.New("no repository to prune, orches not initialized")
+
+	manifest, err := syncer.LoadManifest(manifestPath())
+	if err != nil {
+		return err
 	}
 
 	blank, err := os.MkdirTemp("", "orches-prune-")
@@ -600,12 +1359,35 @@ func doPrune(dryRun bool) error {
 	}
 	defer os.RemoveAll(blank)
 
+	// With a manifest, the deployed units are known even if the repository is lost.
+	oldTree := os.DirFS(blank)
+	if _, err := os.Stat(repoDir); errors.Is(err, os.ErrNotExist) {
+		if manifest == nil {
+			return errors.New("no repository to prune, orches not initialized")
+		}
+	} else {
+		// The repository is removed, so it is read with the backend it was cloned with. orches switch
+		// uses --git-backend for the new clone.
+		repo, tree, err := openHead("", repoDir)
+		if err != nil && manifest == nil {
+			return err
+		} else if err != nil {
+			slog.Warn("Failed to read the repository, pruning units from the manifest", "error", err)
+		} else {
+			defer repo.Close()
+			oldTree = tree
+		}
+	}
+
 	prunePostSyncAction := func(isDryRun bool) error {
 		if !isDryRun {
 			slog.Info("PostSyncAction(doPrune): Removing repository directory", "path", repoDir)
 			if err := os.RemoveAll(repoDir); err != nil {
 				return fmt.Errorf("failed to remove repository directory %s: %w", repoDir, err)
 			}
+			if err := os.Remove(manifestPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove manifest: %w", err)
+			}
 			fmt.Fprintf(os.Stderr, "Repository pruned from %s\n", repoDir)
 		} else {
 			fmt.Fprintf(os.Stderr, "PostSyncAction(doPrune): Dry run, would remove repository directory %s\n", repoDir)
@@ -613,7 +1395,7 @@ func doPrune(dryRun bool) error {
 		return nil
 	}
 
-	if _, err := syncer.SyncDirs(repoDir, blank, dryRun, prunePostSyncAction); err != nil {
+	if _, err := syncer.SyncTrees(oldTree, os.DirFS(blank), manifest, dryRun, 0, prunePostSyncAction); err != nil {
 		return fmt.Errorf("failed to sync directories for prune: %w", err)
 	}
 
@@ -621,15 +1403,43 @@ func doPrune(dryRun bool) error {
 	return nil
 }
 
-func cmdSwitch(remote string, flags rootFlags) error {
+// openHead opens the repository at repoDir with backend, and returns the
+// tree of the deployed commit. The repository must be closed once the tree
+// is not needed.
+func openHead(backend, repoDir string) (git.Repo, fs.FS, error) {
+	repo, err := git.Open(backend, repoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree, err := repo.Tree("HEAD")
+	if err != nil {
+		repo.Close()
+		return nil, nil, fmt.Errorf("failed to read tree of HEAD: %w", err)
+	}
+	return repo, tree, nil
+}
+
+func cmdSwitch(remote, ref string, opts git.CloneOptions, flags rootFlags) error {
+	// Unsupported options must not leave the host without a deployment.
+	if err := opts.Validate(gitBackend, remote); err != nil {
+		return err
+	}
+
 	return lock(func() error {
+		// Units of the new remote must not overwrite files that the current deployment does not own,
+		// this has to be checked before anything is pruned.
+		if err := checkSwitch(remote, ref, opts); err != nil {
+			return err
+		}
+
 		// First prune the existing deployment
 		if err := doPrune(flags.dryRun); err != nil {
 			return fmt.Errorf("failed to prune existing deployment: %w", err)
 		}
 
 		// Then initialize with the new remote
-		if err := doInit(remote, flags.dryRun); err != nil {
+		if err := doInit(remote, ref, opts, flags, nil); err != nil {
 			return fmt.Errorf("failed to initialize new deployment: %w", err)
 		}
 
@@ -637,13 +1447,122 @@ func cmdSwitch(remote string, flags rootFlags) error {
 	})
 }
 
-func cmdStatus() (string, error) {
+// checkSwitch fails if ref of the repository at remote defines units whose
+// files exist on the host, but are not owned by the current deployment.
+func checkSwitch(remote, ref string, opts git.CloneOptions) error {
+	tmp, err := os.MkdirTemp("", "orches-switch-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo, err := git.Clone(gitBackend, remote, tmp, opts)
+	if err != nil {
+		return fmt.Errorf("failed to clone repo: %w", err)
+	}
+	defer repo.Close()
+
+	commit := "HEAD"
+	if ref != "" {
+		if commit, err = git.ResolveTarget(repo, ref); err != nil {
+			return err
+		}
+	}
+
+	tree, err := repo.Tree(commit)
+	if err != nil {
+		return fmt.Errorf("failed to read tree of %s: %w", commit, err)
+	}
+
+	manifest, err := syncer.LoadManifest(manifestPath())
+	if err != nil {
+		return err
+	}
+
+	// Deployments from older versions of orches own all units of the deployed commit.
+	repoDir := filepath.Join(baseDir, "repo")
+	if _, err := os.Stat(repoDir); manifest == nil && err == nil {
+		oldRepo, oldTree, err := openHead("", repoDir)
+		if err != nil {
+			return err
+		}
+		defer oldRepo.Close()
+
+		manifest, err = syncer.NewManifest(oldTree, "")
+		if err != nil {
+			return fmt.Errorf("failed to create manifest: %w", err)
+		}
+	}
+
+	unmanaged, err := syncer.FindUnmanaged(tree, manifest)
+	if err != nil {
+		return fmt.Errorf("failed to check for existing units: %w", err)
+	}
+	if len(unmanaged) > 0 {
+		return fmt.Errorf("refusing to switch, the new repository would overwrite unmanaged unit files: %s. Remove them, or prune orches and use orches init --adopt to take ownership of them", unmanagedPaths(unmanaged))
+	}
+
+	return nil
+}
+
+type statusResult struct {
+	Remote string              `json:"remote" yaml:"remote"`
+	Target string              `json:"target,omitempty" yaml:"target,omitempty"`
+	Ref    string              `json:"ref" yaml:"ref"`
+	Units  []syncer.UnitStatus `json:"units" yaml:"units"`
+
+	// Refused describes why the latest target commit was not deployed.
+	Refused string `json:"refused,omitempty" yaml:"refused,omitempty"`
+	// Rejected is the commit that was rolled back, and is not deployed
+	// until the target moves on.
+	Rejected string `json:"rejected,omitempty" yaml:"rejected,omitempty"`
+}
+
+func (s statusResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "remote: %s\n", s.Remote)
+	if s.Target != "" {
+		fmt.Fprintf(&b, "target: %s\n", s.Target)
+	}
+	fmt.Fprintf(&b, "ref: %s\n", s.Ref)
+	if s.Refused != "" {
+		fmt.Fprintf(&b, "refused: %s\n", s.Refused)
+	}
+	if s.Rejected != "" {
+		fmt.Fprintf(&b, "rejected: %s (rolled back, waiting for a new commit)\n", s.Rejected)
+	}
+
+	if len(s.Units) == 0 {
+		b.WriteString("\nNo units deployed.")
+		return b.String()
+	}
+
+	b.WriteString("\n")
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "UNIT\tSYSTEMCTL NAME\tSTATE\tENABLED\tIN SYNC\tPATH")
+	for _, u := range s.Units {
+		inSync := "yes"
+		if !u.InSync {
+			inSync = "no: " + u.Drift
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s (%s)\t%s\t%s\t%s\n", u.RepoPath, u.SystemctlName, u.ActiveState, u.SubState, u.EnabledState, inSync, u.Path)
+	}
+	w.Flush()
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func cmdStatus(output string) (string, error) {
 	repoDir := path.Join(baseDir, "repo")
 	if _, err := os.Stat(repoDir); errors.Is(err, os.ErrNotExist) {
 		return "", errors.New("no repository found, initalize orches first")
 	}
 
-	repo := git.Repo{Path: repoDir}
+	repo, err := git.Open(gitBackend, repoDir)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Close()
 
 	remoteURL, err := repo.RemoteURL("origin")
 	if err != nil {
@@ -655,6 +1574,31 @@ func cmdStatus() (string, error) {
 		return "", fmt.Errorf("failed to get HEAD: %w", err)
 	}
 
-	buf := fmt.Sprintf("remote: %s\nref: %s", remoteURL, head)
-	return buf, nil
+	target, err := repo.TargetRef()
+	if err != nil {
+		return "", err
+	}
+
+	rejected, err := repo.RejectedCommit()
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := repo.Tree(head)
+	if err != nil {
+		return "", fmt.Errorf("failed to read tree of %s: %w", head, err)
+	}
+
+	units, err := syncer.UnitStatuses(tree)
+	if err != nil {
+		return "", fmt.Errorf("failed to get unit status: %w", err)
+	}
+
+	refused, err := os.ReadFile(refusalPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read refusal: %w", err)
+	}
+
+	status := statusResult{Remote: remoteURL, Target: target, Ref: head, Units: units, Refused: string(refused), Rejected: rejected}
+	return formatOutput(output, status, status.String)
 }
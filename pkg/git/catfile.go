@@ -0,0 +1,98 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// catFile reads objects through a single git cat-file --batch process, so
+// reading many files does not start a git process for each of them.
+type catFile struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *bytes.Buffer
+
+	// broken is set once the output of the process can no longer be read.
+	broken bool
+}
+
+// startCatFile starts git cat-file in the repository at path, with the git
+// options in args.
+func startCatFile(path string, args []string) (*catFile, error) {
+	cmd := exec.Command("git", append(append([]string{"-C", path}, args...), "cat-file", "--batch")...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start git cat-file: %w", err)
+	}
+
+	return &catFile{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout), stderr: stderr}, nil
+}
+
+// read returns the contents of the object. If the process fails, or its
+// output cannot be parsed, it is stopped and marked broken.
+func (c *catFile) read(hash string) ([]byte, error) {
+	if _, err := io.WriteString(c.stdin, hash+"\n"); err != nil {
+		return nil, c.failed(err)
+	}
+
+	// <oid> SP <type> SP <size> LF <contents> LF, or <object> SP missing LF
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, c.failed(err)
+	}
+
+	fields := strings.Fields(header)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return nil, fmt.Errorf("failed to read object %s: object is missing", hash)
+	}
+	if len(fields) != 3 {
+		return nil, c.failed(fmt.Errorf("unexpected header %q", strings.TrimSpace(header)))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, c.failed(fmt.Errorf("invalid size %s", fields[2]))
+	}
+
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(c.stdout, data); err != nil {
+		return nil, c.failed(err)
+	}
+
+	return data[:size], nil
+}
+
+// failed stops the process, its output is out of sync with the requests.
+func (c *catFile) failed(err error) error {
+	c.broken = true
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+
+	return fmt.Errorf("failed to read from git cat-file: %w\noutput:\n%s", err, c.stderr.String())
+}
+
+func (c *catFile) close() error {
+	if c.broken {
+		return nil
+	}
+
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
@@ -0,0 +1,396 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/orches-team/orches/pkg/utils"
+)
+
+// cliRepo implements Repo by running the git binary.
+type cliRepo struct {
+	path string
+
+	// objects reads files of trees, it is started on the first read.
+	objectsMu sync.Mutex
+	objects   *catFile
+}
+
+func cloneCLI(remote, path string, opts CloneOptions) (*cliRepo, error) {
+	creds, err := opts.Credentials.gitArgs(remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone repo: %w", err)
+	}
+
+	args := append(append([]string{"git"}, creds...), "clone")
+	if opts.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.Depth), "--no-single-branch")
+	}
+	if opts.Filter != "" {
+		args = append(args, "--filter", opts.Filter)
+	}
+
+	if err := utils.ExecNoOutput(append(args, remote, path)...); err != nil {
+		return nil, fmt.Errorf("failed to clone repo: %w", err)
+	}
+	if err := utils.ExecNoOutput("git", "-C", path, "config", backendConfigKey, BackendCLI); err != nil {
+		return nil, fmt.Errorf("failed to store git backend: %w", err)
+	}
+
+	r := &cliRepo{path: path}
+	for key, value := range opts.Credentials.configKeys() {
+		if *value == "" {
+			continue
+		}
+		if err := utils.ExecNoOutput("git", "-C", path, "config", key, *value); err != nil {
+			return nil, fmt.Errorf("failed to store credentials: %w", err)
+		}
+	}
+
+	if opts.Depth > 0 {
+		if err := utils.ExecNoOutput("git", "-C", path, "config", depthConfigKey, strconv.Itoa(opts.Depth)); err != nil {
+			return nil, fmt.Errorf("failed to set depth: %w", err)
+		}
+
+		// Tags outside of the cloned history are not cloned.
+		if err := r.Fetch("origin"); err != nil {
+			return nil, fmt.Errorf("failed to fetch tags: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// Fetch fetches branches and tags of the remote. Tags moved on the remote
+// are updated. The filter of a partial clone is applied by git itself.
+func (r *cliRepo) Fetch(remote string) error {
+	creds, err := r.credentialArgs(remote)
+	if err != nil {
+		return fmt.Errorf("failed to fetch from %s: %w", remote, err)
+	}
+
+	args := append(append([]string{"git", "-C", r.path}, creds...), "fetch", "--tags", "--force")
+
+	depth, err := r.config("--get", depthConfigKey)
+	if err != nil {
+		return err
+	}
+	if depth != "" {
+		args = append(args, "--depth", depth)
+	}
+
+	return utils.ExecNoOutput(append(args, remote)...)
+}
+
+// credentialArgs returns the git options that apply the credentials stored
+// in the git config to remote.
+func (r *cliRepo) credentialArgs(remote string) ([]string, error) {
+	url, err := r.RemoteURL(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := r.config("--get-regexp", `^orches\.`)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds Credentials
+	keys := creds.configKeys()
+	for _, line := range strings.Split(out, "\n") {
+		// git prints the keys in lower case.
+		name, value, _ := strings.Cut(line, " ")
+		for key, field := range keys {
+			if strings.EqualFold(key, name) {
+				*field = value
+			}
+		}
+	}
+
+	return creds.gitArgs(url)
+}
+
+// objectsArgs returns the credential options for commands that read
+// objects. Only partial clones fetch missing objects from the remote.
+func (r *cliRepo) objectsArgs() ([]string, error) {
+	if !r.isPartial() {
+		return nil, nil
+	}
+
+	return r.credentialArgs("origin")
+}
+
+func (r *cliRepo) isPartial() bool {
+	promisor, err := r.config("--get", "remote.origin.promisor")
+	return err == nil && promisor == "true"
+}
+
+// prefetch fetches the objects that are missing in a partial clone with a
+// single request, just like git does for checkouts.
+func (r *cliRepo) prefetch(ref string, hashes []string, creds []string) error {
+	// Objects of the tree of ref that are not in the local object storage are printed as ?<hash>.
+	out, err := utils.ExecStdout("git", "-C", r.path, "rev-list", "--objects", "--no-walk", "--missing=print", ref)
+	if err != nil {
+		return fmt.Errorf("failed to list missing objects: %w", err)
+	}
+
+	var missing []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if hash, ok := strings.CutPrefix(line, "?"); ok && slices.Contains(hashes, hash) {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	args := append(append([]string{"git", "-C", r.path}, creds...),
+		"-c", "fetch.negotiationAlgorithm=noop", "fetch", "--quiet",
+		"--no-tags", "--no-write-fetch-head", "--recurse-submodules=no", "--filter=blob:none", "origin",
+	)
+	if err := utils.ExecNoOutput(append(args, missing...)...); err != nil {
+		return fmt.Errorf("failed to fetch missing objects: %w", err)
+	}
+	return nil
+}
+
+func (r *cliRepo) Ref(ref string) (string, error) {
+	out, err := utils.ExecOutput("git", "-C", r.path, "rev-parse", "--verify", "--quiet", ref)
+	if err != nil {
+		return "", &ErrUnknownRef{Ref: ref, err: err}
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *cliRepo) Reset(ref string) error {
+	creds, err := r.objectsArgs()
+	if err != nil {
+		return fmt.Errorf("failed to reset to %s: %w", ref, err)
+	}
+
+	return utils.ExecNoOutput(append(append([]string{"git", "-C", r.path}, creds...), "reset", "--hard", ref)...)
+}
+
+func (r *cliRepo) RemoteURL(remote string) (string, error) {
+	out, err := utils.ExecOutput("git", "-C", r.path, "remote", "get-url", remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to get remote URL: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Tree lists the tree of ref with git ls-tree, and reads files with a
+// single git cat-file process shared by all trees of the repository.
+func (r *cliRepo) Tree(ref string) (fs.FS, error) {
+	creds, err := r.objectsArgs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree of %s: %w", ref, err)
+	}
+
+	out, err := utils.ExecStdout(append(append([]string{"git", "-C", r.path}, creds...), "ls-tree", "-r", "-t", "-z", "--full-tree", ref)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tree of %s: %w", ref, err)
+	}
+
+	tree := newTreeFS(r.readObject, func(hash string) (int64, error) {
+		data, err := r.readObject(hash)
+		return int64(len(data)), err
+	})
+
+	// Without prefetching, a partial clone fetches missing files one by one.
+	if r.isPartial() {
+		tree.prefetch = func(hashes []string) error {
+			return r.prefetch(ref, hashes, creds)
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		if line == "" {
+			continue
+		}
+
+		// <mode> SP <type> SP <object> TAB <file>
+		meta, name, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 3 {
+			return nil, fmt.Errorf("failed to parse tree entry %q", line)
+		}
+
+		switch fields[0] {
+		case "040000":
+			tree.add(name, fs.ModeDir|0755, "")
+		case "100644":
+			tree.add(name, 0644, fields[2])
+		case "100755":
+			tree.add(name, 0755, fields[2])
+		case "120000":
+			tree.add(name, fs.ModeSymlink|0777, fields[2])
+		}
+		// Submodules are not checked out.
+	}
+
+	return tree, nil
+}
+
+// readObject reads an object with the git cat-file process shared by all
+// trees of the repository. A broken process is replaced on the next read.
+func (r *cliRepo) readObject(hash string) ([]byte, error) {
+	r.objectsMu.Lock()
+	defer r.objectsMu.Unlock()
+
+	if r.objects == nil {
+		// Partial clones fetch missing objects on read.
+		creds, err := r.objectsArgs()
+		if err != nil {
+			return nil, err
+		}
+		objects, err := startCatFile(r.path, creds)
+		if err != nil {
+			return nil, err
+		}
+		r.objects = objects
+	}
+
+	data, err := r.objects.read(hash)
+	if r.objects.broken {
+		r.objects = nil
+	}
+	return data, err
+}
+
+// Close stops the git cat-file process. Trees of the repository can still be
+// read, the process is started again when needed.
+func (r *cliRepo) Close() error {
+	r.objectsMu.Lock()
+	defer r.objectsMu.Unlock()
+
+	if r.objects == nil {
+		return nil
+	}
+
+	err := r.objects.close()
+	r.objects = nil
+	return err
+}
+
+func (r *cliRepo) Tags() ([]string, error) {
+	out, err := utils.ExecOutput("git", "-C", r.path, "tag", "--list")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+func (r *cliRepo) TargetRef() (string, error) {
+	ref, err := r.config("--get", refConfigKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get target ref: %w", err)
+	}
+	return ref, nil
+}
+
+func (r *cliRepo) SetTargetRef(ref string) error {
+	if err := utils.ExecNoOutput("git", "-C", r.path, "config", refConfigKey, ref); err != nil {
+		return fmt.Errorf("failed to set target ref: %w", err)
+	}
+	return nil
+}
+
+func (r *cliRepo) RejectedCommit() (string, error) {
+	commit, err := r.config("--get", rejectedConfigKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get rejected commit: %w", err)
+	}
+	return commit, nil
+}
+
+func (r *cliRepo) SetRejectedCommit(commit string) error {
+	if commit == "" {
+		// git config --unset fails if the key is not set.
+		current, err := r.RejectedCommit()
+		if err != nil || current == "" {
+			return err
+		}
+		if err := utils.ExecNoOutput("git", "-C", r.path, "config", "--unset", rejectedConfigKey); err != nil {
+			return fmt.Errorf("failed to clear rejected commit: %w", err)
+		}
+		return nil
+	}
+
+	if err := utils.ExecNoOutput("git", "-C", r.path, "config", rejectedConfigKey, commit); err != nil {
+		return fmt.Errorf("failed to set rejected commit: %w", err)
+	}
+	return nil
+}
+
+// config runs git config with args, and returns its output. A key that is
+// not set is returned as an empty string.
+func (r *cliRepo) config(args ...string) (string, error) {
+	out, err := utils.ExecOutput(append([]string{"git", "-C", r.path, "config"}, args...)...)
+	var exitErr *exec.ExitError
+	// git config exits with 1 if no key is set.
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *cliRepo) VerifyCommits(keys *TrustedKeys, from, to string) error {
+	commits := []string{to}
+	if from != "" && r.isAncestor(from, to) {
+		out, err := utils.ExecOutput("git", "-C", r.path, "rev-list", from+".."+to)
+		if err != nil {
+			return fmt.Errorf("failed to list commits: %w", err)
+		}
+		commits = strings.Fields(string(out))
+	}
+
+	// GPG keys are imported into a temporary keyring, so only they are trusted.
+	gnupgHome, err := os.MkdirTemp("", "orches-gnupg-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(gnupgHome)
+
+	if len(keys.gpgKeys) > 0 {
+		args := append([]string{"gpg", "--batch", "--homedir", gnupgHome, "--import"}, keys.gpgKeys...)
+		if err := utils.ExecNoOutput(args...); err != nil {
+			return fmt.Errorf("failed to import trusted GPG keys: %w", err)
+		}
+	}
+
+	// An empty allowed signers file makes git refuse all SSH signatures.
+	allowedSigners := keys.allowedSigners
+	if allowedSigners == "" {
+		allowedSigners = os.DevNull
+	}
+
+	for _, commit := range commits {
+		out, err := utils.ExecOutputEnv(
+			[]string{"GNUPGHOME=" + gnupgHome},
+			"git", "-C", r.path, "-c", "gpg.ssh.allowedSignersFile="+allowedSigners, "verify-commit", commit,
+		)
+		if err != nil {
+			return &ErrUntrusted{Commit: commit, output: strings.TrimSpace(string(out))}
+		}
+	}
+
+	return nil
+}
+
+func (r *cliRepo) isAncestor(ancestor, commit string) bool {
+	return utils.ExecNoOutput("git", "-C", r.path, "merge-base", "--is-ancestor", ancestor, commit) == nil
+}
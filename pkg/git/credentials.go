@@ -0,0 +1,212 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// tokenUser is the user name sent with HTTPS tokens. GitHub requires it for
+// GitHub App tokens, other forges accept any user name with a token.
+const tokenUser = "x-access-token"
+
+// Credentials authenticate orches to a private remote. They hold paths and
+// names of secrets, not the secrets themselves, so they can be stored in the
+// git config of the repository. Secrets are read every time they are used.
+type Credentials struct {
+	// SSHKey is the path of a private SSH key, it must not be encrypted.
+	SSHKey string `json:"sshKey,omitempty"`
+	// KnownHosts is the path of a known_hosts file. Only host keys listed
+	// in it are accepted.
+	KnownHosts string `json:"knownHosts,omitempty"`
+
+	// TokenFile is the path of a file with an HTTPS token.
+	TokenFile string `json:"tokenFile,omitempty"`
+	// TokenCredential is the name of a systemd credential with an HTTPS
+	// token, it is read from $CREDENTIALS_DIRECTORY.
+	TokenCredential string `json:"tokenCredential,omitempty"`
+
+	// GitHubAppID, GitHubAppInstallationID and GitHubAppKey, the path of the
+	// private key of the app, request short-lived installation tokens.
+	GitHubAppID             string `json:"githubAppId,omitempty"`
+	GitHubAppInstallationID string `json:"githubAppInstallationId,omitempty"`
+	GitHubAppKey            string `json:"githubAppKey,omitempty"`
+}
+
+// configKeys maps the git config keys that store the credentials to their
+// fields.
+func (c *Credentials) configKeys() map[string]*string {
+	return map[string]*string{
+		"orches.sshKey":                  &c.SSHKey,
+		"orches.knownHosts":              &c.KnownHosts,
+		"orches.tokenFile":               &c.TokenFile,
+		"orches.tokenCredential":         &c.TokenCredential,
+		"orches.githubAppId":             &c.GitHubAppID,
+		"orches.githubAppInstallationId": &c.GitHubAppInstallationID,
+		"orches.githubAppKey":            &c.GitHubAppKey,
+	}
+}
+
+func (c Credentials) validate() error {
+	for _, p := range []string{c.SSHKey, c.KnownHosts, c.TokenFile, c.GitHubAppKey} {
+		if p == "" {
+			continue
+		}
+		// The daemon may run in a different working directory.
+		if !path.IsAbs(p) {
+			return fmt.Errorf("credential path %s is not absolute", p)
+		}
+		if _, err := os.Stat(p); err != nil {
+			return fmt.Errorf("failed to read credential: %w", err)
+		}
+	}
+
+	isApp := c.GitHubAppID != "" || c.GitHubAppInstallationID != "" || c.GitHubAppKey != ""
+	sources := 0
+	for _, set := range []bool{c.TokenFile != "", c.TokenCredential != "", isApp} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of a token file, a token credential, or a GitHub App can be used")
+	}
+
+	if c.TokenCredential != "" && strings.Contains(c.TokenCredential, "/") {
+		return fmt.Errorf("invalid credential name %s", c.TokenCredential)
+	}
+
+	if isApp {
+		if c.GitHubAppID == "" || c.GitHubAppInstallationID == "" || c.GitHubAppKey == "" {
+			return errors.New("a GitHub App needs an app ID, an installation ID, and a private key")
+		}
+		if _, err := strconv.ParseInt(c.GitHubAppInstallationID, 10, 64); err != nil {
+			return fmt.Errorf("invalid GitHub App installation ID %s", c.GitHubAppInstallationID)
+		}
+	}
+
+	return nil
+}
+
+// token returns the HTTPS token, or an empty string if none is configured.
+func (c Credentials) token() (string, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case c.TokenFile != "":
+		data, err = os.ReadFile(c.TokenFile)
+	case c.TokenCredential != "":
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("failed to read credential %s: CREDENTIALS_DIRECTORY is not set, load it with LoadCredential= in the unit of orches", c.TokenCredential)
+		}
+		data, err = os.ReadFile(path.Join(dir, c.TokenCredential))
+	case c.GitHubAppID != "":
+		return githubAppToken(c.GitHubAppID, c.GitHubAppInstallationID, c.GitHubAppKey)
+	default:
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// gitArgs returns the git options that apply the credentials to remote.
+// Tokens are not passed to git, git asks orches for them with a credential
+// helper, only when remote requires authentication.
+func (c Credentials) gitArgs(remote string) ([]string, error) {
+	var args []string
+
+	if c.SSHKey != "" || c.KnownHosts != "" {
+		command := []string{"ssh"}
+		if c.SSHKey != "" {
+			command = append(command, "-i", shellQuote(c.SSHKey), "-o", "IdentitiesOnly=yes")
+		}
+		if c.KnownHosts != "" {
+			command = append(command,
+				"-o", shellQuote("UserKnownHostsFile="+c.KnownHosts),
+				"-o", "GlobalKnownHostsFile=/dev/null",
+				"-o", "StrictHostKeyChecking=yes",
+			)
+		}
+		args = append(args, "-c", "core.sshCommand="+strings.Join(command, " "))
+	}
+
+	helper, err := c.helperCommand()
+	if err != nil {
+		return nil, err
+	}
+	if helper != "" {
+		// The helper is scoped to the remote, so the token is not sent to
+		// other hosts, e.g. of submodules. The empty value drops helpers of
+		// the global git config.
+		key := "credential." + remote + ".helper"
+		args = append(args, "-c", key+"=", "-c", key+"="+helper)
+	}
+
+	return args, nil
+}
+
+// helperCommand returns the credential helper that runs orches git-credential
+// with the token source, or an empty string if none is configured. Only
+// paths and names of secrets are passed.
+func (c Credentials) helperCommand() (string, error) {
+	var flags []string
+	for _, f := range []struct{ name, value string }{
+		{"--token-file", c.TokenFile},
+		{"--token-credential", c.TokenCredential},
+		{"--github-app-id", c.GitHubAppID},
+		{"--github-app-installation-id", c.GitHubAppInstallationID},
+		{"--github-app-key", c.GitHubAppKey},
+	} {
+		if f.value != "" {
+			flags = append(flags, f.name, shellQuote(f.value))
+		}
+	}
+	if len(flags) == 0 {
+		return "", nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the orches executable: %w", err)
+	}
+
+	return "!" + shellQuote(exe) + " git-credential " + strings.Join(flags, " "), nil
+}
+
+// CredentialHelper implements the git credential helper protocol for the
+// token of the credentials. Only the get action returns credentials, the
+// store and erase actions are ignored.
+func CredentialHelper(c Credentials, action string, in io.Reader, out io.Writer) error {
+	// git writes the request first, it fails if it is not read.
+	if _, err := io.Copy(io.Discard, in); err != nil {
+		return fmt.Errorf("failed to read credential request: %w", err)
+	}
+	if action != "get" {
+		return nil
+	}
+
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return nil
+	}
+
+	_, err = fmt.Fprintf(out, "username=%s\npassword=%s\n", tokenUser, token)
+	return err
+}
+
+// shellQuote quotes s for commands git runs with a shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -3,73 +3,186 @@ package git
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/orches-team/orches/pkg/utils"
+	"github.com/go-git/go-git/v5/config"
 )
 
-type Repo struct {
-	Path string
-}
+// Backends that implement Repo.
+const (
+	// BackendCLI runs the git binary.
+	BackendCLI = "cli"
+	// BackendGo is implemented natively in Go, it needs no git binary.
+	BackendGo = "go"
+)
 
-func Clone(remote, path string) (*Repo, error) {
-	if err := utils.ExecNoOutput("git", "clone", remote, path); err != nil {
-		return nil, fmt.Errorf("failed to clone repo: %w", err)
-	}
+var Backends = []string{BackendCLI, BackendGo}
+
+// Git config keys orches stores its state in.
+const (
+	// backendConfigKey stores the backend the repository was cloned with.
+	backendConfigKey = "orches.backend"
+	// refConfigKey stores the ref orches follows.
+	refConfigKey = "orches.ref"
+	// depthConfigKey stores the depth of a shallow clone.
+	depthConfigKey = "orches.depth"
+	// rejectedConfigKey stores the commit that failed to deploy, and was
+	// rolled back.
+	rejectedConfigKey = "orches.rejected"
+)
 
-	return &Repo{Path: path}, nil
-}
+// CloneOptions limit what is cloned, and fetched later, and how orches
+// authenticates to the remote.
+type CloneOptions struct {
+	// Depth limits the history to the given number of commits from the tips
+	// of branches and tags. Zero clones the full history.
+	Depth int
 
-func (r *Repo) Fetch(remote string) error {
-	return utils.ExecNoOutput("git", "-C", r.Path, "fetch", remote)
+	// Filter is a partial clone filter like blob:none. Filtered objects are
+	// fetched on demand. Only the cli backend supports it.
+	Filter string
+
+	// Credentials are stored in the git config of the clone, and used for
+	// every later fetch.
+	Credentials Credentials
 }
 
-func (r *Repo) Ref(ref string) (string, error) {
-	out, err := utils.ExecOutput("git", "-C", r.Path, "rev-parse", ref)
-	if err != nil {
-		return "", fmt.Errorf("failed to get ref: %w", err)
+// Validate checks that the backend supports the options for cloning remote.
+// An empty backend is the cli backend, like in Clone.
+func (o CloneOptions) Validate(backend, remote string) error {
+	if backend == "" {
+		backend = BackendCLI
+	}
+	if o.Depth < 0 {
+		return fmt.Errorf("invalid depth %d", o.Depth)
+	}
+	if o.Filter != "" && backend != BackendCLI {
+		return fmt.Errorf("partial clones are not supported by the %s git backend", backend)
 	}
 
-	return strings.TrimSpace(string(out)), nil
+	// The go backend serves local repositories in-process, without support for shallow clones.
+	isLocal := IsLocalEndpoint(remote) || strings.HasPrefix(remote, "file://")
+	if o.Depth > 0 && backend == BackendGo && isLocal {
+		return fmt.Errorf("shallow clones of local repositories are not supported by the %s git backend", backend)
+	}
+
+	return o.Credentials.validate()
 }
 
-func (r *Repo) Reset(ref string) error {
-	return utils.ExecNoOutput("git", "-C", r.Path, "reset", "--hard", ref)
+// Repo is a local clone of the repository orches deploys from.
+type Repo interface {
+	// Fetch fetches branches and tags of the remote, with the depth the
+	// repository was cloned with.
+	Fetch(remote string) error
+	// Ref resolves ref to a commit hash.
+	Ref(ref string) (string, error)
+	// Reset resets the checkout, and the current branch to ref.
+	Reset(ref string) error
+	RemoteURL(remote string) (string, error)
+	// Tree returns the files of the commit at ref. They are read directly
+	// from the object storage, nothing is checked out.
+	Tree(ref string) (fs.FS, error)
+	// Tags returns names of all tags.
+	Tags() ([]string, error)
+
+	// TargetRef returns the ref orches follows, as given to init or
+	// switch. An empty string means the upstream of the cloned branch.
+	TargetRef() (string, error)
+	// SetTargetRef stores the ref orches follows.
+	SetTargetRef(ref string) error
+
+	// RejectedCommit returns the commit that failed to deploy and was rolled
+	// back, or an empty string.
+	RejectedCommit() (string, error)
+	// SetRejectedCommit stores the commit that was rolled back, an empty
+	// commit clears it.
+	SetRejectedCommit(commit string) error
+
+	// VerifyCommits verifies that all commits in from..to are signed by one
+	// of the trusted keys. If from is empty, or not an ancestor of to, e.g.
+	// after a force-push, only to is verified.
+	VerifyCommits(keys *TrustedKeys, from, to string) error
+
+	// Close stops background processes of the repository.
+	Close() error
 }
 
-func (r *Repo) RemoteURL(remote string) (string, error) {
-	out, err := utils.ExecOutput("git", "-C", r.Path, "remote", "get-url", remote)
+// Open opens the repository at path with the backend it was cloned with.
+// An explicit backend that differs from it is refused.
+func Open(backend, path string) (Repo, error) {
+	stored, err := clonedBackend(path)
 	if err != nil {
-		return "", fmt.Errorf("failed to get remote URL: %w", err)
+		return nil, err
+	}
+	if backend != "" && backend != stored {
+		return nil, fmt.Errorf("repository was cloned with the %s git backend, not %s, use orches switch to change the backend", stored, backend)
 	}
 
-	return strings.TrimSpace(string(out)), nil
+	switch stored {
+	case BackendCLI:
+		return &cliRepo{path: path}, nil
+	case BackendGo:
+		return openGoRepo(path)
+	default:
+		return nil, fmt.Errorf("unknown git backend %s", stored)
+	}
 }
 
-type worktree struct {
-	Path string
+// Clone clones remote into path with the given backend, cli if it is empty.
+// The backend is stored in the git config of the clone, and used by Open. A
+// shallow clone fetches all branches and tags, not just the default branch.
+func Clone(backend, remote, path string, opts CloneOptions) (Repo, error) {
+	if err := opts.Validate(backend, remote); err != nil {
+		return nil, err
+	}
 
-	repo *Repo
+	switch backend {
+	case BackendCLI, "":
+		return cloneCLI(remote, path, opts)
+	case BackendGo:
+		return cloneGo(remote, path, opts)
+	default:
+		return nil, fmt.Errorf("unknown git backend %s", backend)
+	}
 }
 
-func (r *Repo) NewWorktree(ref string) (*worktree, error) {
-	worktreeDir, err := os.MkdirTemp("", "orches-worktree-")
+// clonedBackend reads the backend the repository at path was cloned with.
+// The config is parsed directly, so that no backend is needed to read it.
+// Repositories cloned before the backend was stored use the cli backend.
+func clonedBackend(path string) (string, error) {
+	f, err := os.Open(filepath.Join(path, ".git", "config"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to open repo: %s is not a git repository", path)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to open repo: %w", err)
+	}
+	defer f.Close()
+
+	cfg, err := config.ReadConfig(f)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		return "", fmt.Errorf("failed to read repo config: %w", err)
 	}
 
-	if err := utils.ExecNoOutput("git", "-C", r.Path, "worktree", "add", worktreeDir, ref); err != nil {
-		return nil, fmt.Errorf("failed to create worktree: %w", err)
+	section, key, _ := strings.Cut(backendConfigKey, ".")
+	if backend := cfg.Raw.Section(section).Option(key); backend != "" {
+		return backend, nil
 	}
+	return BackendCLI, nil
+}
 
-	return &worktree{repo: r, Path: worktreeDir}, nil
+// ErrUnknownRef is returned when a ref cannot be resolved to a commit.
+type ErrUnknownRef struct {
+	Ref string
+	err error
 }
 
-func (wt *worktree) Cleanup() error {
-	var errs []error
-	errs = append(errs, utils.ExecNoOutput("git", "-C", wt.repo.Path, "worktree", "remove", wt.Path))
-	errs = append(errs, os.RemoveAll(wt.Path))
+func (e *ErrUnknownRef) Error() string {
+	return fmt.Sprintf("failed to resolve ref %s: %v", e.Ref, e.err)
+}
 
-	return errors.Join(errs...)
+func (e *ErrUnknownRef) Unwrap() error {
+	return e.err
 }
@@ -0,0 +1,135 @@
+package git
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const githubAPIURL = "https://api.github.com"
+
+// githubToken is an installation token of a GitHub App.
+type githubToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// githubTokens caches installation tokens by app and installation, they are
+// valid for an hour.
+var (
+	githubTokensMu sync.Mutex
+	githubTokens   = map[string]githubToken{}
+)
+
+// githubAppToken returns an installation token of the GitHub App. A new
+// token is requested when the cached one is about to expire.
+func githubAppToken(appID, installationID, keyPath string) (string, error) {
+	githubTokensMu.Lock()
+	defer githubTokensMu.Unlock()
+
+	cacheKey := appID + "/" + installationID
+	if t, ok := githubTokens[cacheKey]; ok && time.Until(t.ExpiresAt) > 5*time.Minute {
+		return t.Token, nil
+	}
+
+	jwt, err := githubAppJWT(appID, keyPath)
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", githubAPIURL, installationID)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request GitHub App token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to request GitHub App token: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed to request GitHub App token: %s: %s", resp.Status, body)
+	}
+
+	var t githubToken
+	if err := json.Unmarshal(body, &t); err != nil {
+		return "", fmt.Errorf("failed to parse GitHub App token: %w", err)
+	}
+	if t.Token == "" {
+		return "", errors.New("failed to parse GitHub App token: no token in the response")
+	}
+
+	githubTokens[cacheKey] = t
+	return t.Token, nil
+}
+
+// githubAppJWT signs the JWT a GitHub App authenticates with.
+func githubAppJWT(appID, keyPath string) (string, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read GitHub App key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("failed to parse GitHub App key %s: no PEM data", keyPath)
+	}
+
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return "", fmt.Errorf("failed to parse GitHub App key %s: not an RSA key", keyPath)
+		}
+		key = rsaKey
+	} else {
+		return "", fmt.Errorf("failed to parse GitHub App key %s: %w", keyPath, err)
+	}
+
+	// The issue time is backdated to allow for clock drift, GitHub accepts
+	// JWTs valid for at most 10 minutes.
+	now := time.Now()
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + encoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
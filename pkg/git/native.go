@@ -0,0 +1,425 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	// The default file transport runs git-upload-pack, serve local
+	// repositories in-process instead.
+	client.InstallProtocol("file", server.NewServer(localLoader{}))
+}
+
+// localLoader loads local repositories for the in-process file transport.
+// Unlike server.DefaultLoader, it supports repositories with a worktree.
+type localLoader struct{}
+
+func (localLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	repo, err := gogit.PlainOpen(ep.Path)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		return nil, transport.ErrRepositoryNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return repo.Storer, nil
+}
+
+// goRepo implements Repo natively in Go.
+type goRepo struct {
+	repo *gogit.Repository
+}
+
+func openGoRepo(path string) (*goRepo, error) {
+	repo, err := gogit.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repo: %w", err)
+	}
+
+	return &goRepo{repo: repo}, nil
+}
+
+func cloneGo(remote, path string, opts CloneOptions) (*goRepo, error) {
+	auth, err := opts.Credentials.auth(remote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone repo: %w", err)
+	}
+
+	repo, err := gogit.PlainClone(path, false, &gogit.CloneOptions{URL: remote, Depth: opts.Depth, Auth: auth})
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone repo: %w", err)
+	}
+
+	r := &goRepo{repo: repo}
+	if err := r.setConfig(backendConfigKey, BackendGo); err != nil {
+		return nil, fmt.Errorf("failed to store git backend: %w", err)
+	}
+
+	for key, value := range opts.Credentials.configKeys() {
+		if err := r.setConfig(key, *value); err != nil {
+			return nil, fmt.Errorf("failed to store credentials: %w", err)
+		}
+	}
+
+	if opts.Depth > 0 {
+		if err := r.setConfig(depthConfigKey, strconv.Itoa(opts.Depth)); err != nil {
+			return nil, fmt.Errorf("failed to set depth: %w", err)
+		}
+
+		// Tags outside of the cloned history are not cloned.
+		if err := r.Fetch("origin"); err != nil {
+			return nil, fmt.Errorf("failed to fetch tags: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// Fetch fetches branches and tags of the remote. Tags moved on the remote
+// are updated.
+func (r *goRepo) Fetch(remote string) error {
+	value, err := r.config(depthConfigKey)
+	if err != nil {
+		return fmt.Errorf("failed to fetch from %s: %w", remote, err)
+	}
+
+	var depth int
+	if value != "" {
+		if depth, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid %s: %w", depthConfigKey, err)
+		}
+	}
+
+	var creds Credentials
+	for key, field := range creds.configKeys() {
+		if *field, err = r.config(key); err != nil {
+			return fmt.Errorf("failed to read credentials: %w", err)
+		}
+	}
+
+	url, err := r.RemoteURL(remote)
+	if err != nil {
+		return err
+	}
+
+	auth, err := creds.auth(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch from %s: %w", remote, err)
+	}
+
+	err = r.repo.Fetch(&gogit.FetchOptions{RemoteName: remote, Tags: gogit.AllTags, Force: true, Depth: depth, Auth: auth})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("failed to fetch from %s: %w", remote, err)
+	}
+	return nil
+}
+
+// auth returns the auth method that applies the credentials to remote, or
+// nil for the defaults of go-git.
+func (c Credentials) auth(remote string) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ep.Protocol {
+	case "ssh":
+		if c.SSHKey == "" && c.KnownHosts == "" {
+			return nil, nil
+		}
+
+		user := ep.User
+		if user == "" {
+			user = gitssh.DefaultUsername
+		}
+
+		var hostKeys ssh.HostKeyCallback
+		if c.KnownHosts != "" {
+			if hostKeys, err = gitssh.NewKnownHostsCallback(c.KnownHosts); err != nil {
+				return nil, fmt.Errorf("failed to read known hosts: %w", err)
+			}
+		}
+
+		if c.SSHKey == "" {
+			agent, err := gitssh.NewSSHAgentAuth(user)
+			if err != nil {
+				return nil, err
+			}
+			agent.HostKeyCallback = hostKeys
+			return agent, nil
+		}
+
+		keys, err := gitssh.NewPublicKeysFromFile(user, c.SSHKey, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		keys.HostKeyCallback = hostKeys
+		return keys, nil
+	case "http", "https":
+		token, err := c.token()
+		if err != nil || token == "" {
+			return nil, err
+		}
+		return &githttp.BasicAuth{Username: tokenUser, Password: token}, nil
+	}
+
+	return nil, nil
+}
+
+// Ref supports the subset of revisions used by orches: HEAD, @{u}, full
+// and short ref names, and commit hashes, optionally with ^{commit}.
+func (r *goRepo) Ref(ref string) (string, error) {
+	hash, err := r.resolve(ref)
+	if err != nil {
+		return "", &ErrUnknownRef{Ref: ref, err: err}
+	}
+	return hash.String(), nil
+}
+
+func (r *goRepo) resolve(ref string) (plumbing.Hash, error) {
+	rev := strings.TrimSuffix(ref, "^{commit}")
+
+	var hash plumbing.Hash
+	if rev == "@{u}" {
+		upstream, err := r.upstream()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hash = upstream
+	} else {
+		h, err := r.repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hash = *h
+	}
+
+	// Annotated tags are peeled to the commit they point to.
+	if tag, err := r.repo.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hash = commit.Hash
+	}
+
+	if _, err := r.repo.CommitObject(hash); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return hash, nil
+}
+
+// upstream resolves the remote-tracking branch of the current branch.
+func (r *goRepo) upstream() (plumbing.Hash, error) {
+	head, err := r.repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if !head.Name().IsBranch() {
+		return plumbing.ZeroHash, errors.New("HEAD is not on a branch")
+	}
+
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	branch, exists := cfg.Branches[head.Name().Short()]
+	if !exists || branch.Remote == "" || branch.Merge == "" {
+		return plumbing.ZeroHash, fmt.Errorf("branch %s has no upstream", head.Name().Short())
+	}
+
+	ref, err := r.repo.Reference(plumbing.NewRemoteReferenceName(branch.Remote, branch.Merge.Short()), true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return ref.Hash(), nil
+}
+
+func (r *goRepo) Reset(ref string) error {
+	hash, err := r.resolve(ref)
+	if err != nil {
+		return &ErrUnknownRef{Ref: ref, err: err}
+	}
+
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if err := wt.Reset(&gogit.ResetOptions{Commit: hash, Mode: gogit.HardReset}); err != nil {
+		return fmt.Errorf("failed to reset to %s: %w", ref, err)
+	}
+	return nil
+}
+
+func (r *goRepo) RemoteURL(remote string) (string, error) {
+	rem, err := r.repo.Remote(remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to get remote URL: %w", err)
+	}
+
+	urls := rem.Config().URLs
+	if len(urls) == 0 {
+		return "", fmt.Errorf("remote %s has no URL", remote)
+	}
+	return urls[0], nil
+}
+
+// Tree walks the tree of ref, files are read from the object storage when
+// they are opened.
+func (r *goRepo) Tree(ref string) (fs.FS, error) {
+	hash, err := r.resolve(ref)
+	if err != nil {
+		return nil, &ErrUnknownRef{Ref: ref, err: err}
+	}
+
+	commit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	tree := newTreeFS(func(hash string) ([]byte, error) {
+		blob, err := r.repo.BlobObject(plumbing.NewHash(hash))
+		if err != nil {
+			return nil, err
+		}
+
+		reader, err := blob.Reader()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return io.ReadAll(reader)
+	}, func(hash string) (int64, error) {
+		return r.repo.Storer.EncodedObjectSize(plumbing.NewHash(hash))
+	})
+
+	walker := object.NewTreeWalker(root, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list tree of %s: %w", ref, err)
+		}
+
+		switch entry.Mode {
+		case filemode.Dir:
+			tree.add(name, fs.ModeDir|0755, "")
+		case filemode.Regular, filemode.Deprecated:
+			tree.add(name, 0644, entry.Hash.String())
+		case filemode.Executable:
+			tree.add(name, 0755, entry.Hash.String())
+		case filemode.Symlink:
+			tree.add(name, fs.ModeSymlink|0777, entry.Hash.String())
+		}
+		// Submodules are not checked out.
+	}
+
+	return tree, nil
+}
+
+// Close does nothing, everything runs in-process.
+func (r *goRepo) Close() error {
+	return nil
+}
+
+func (r *goRepo) Tags() ([]string, error) {
+	iter, err := r.repo.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	var tags []string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		tags = append(tags, ref.Name().Short())
+		return nil
+	})
+	return tags, err
+}
+
+func (r *goRepo) TargetRef() (string, error) {
+	ref, err := r.config(refConfigKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get target ref: %w", err)
+	}
+	return ref, nil
+}
+
+func (r *goRepo) SetTargetRef(ref string) error {
+	if err := r.setConfig(refConfigKey, ref); err != nil {
+		return fmt.Errorf("failed to set target ref: %w", err)
+	}
+	return nil
+}
+
+func (r *goRepo) RejectedCommit() (string, error) {
+	commit, err := r.config(rejectedConfigKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get rejected commit: %w", err)
+	}
+	return commit, nil
+}
+
+func (r *goRepo) SetRejectedCommit(commit string) error {
+	if err := r.setConfig(rejectedConfigKey, commit); err != nil {
+		return fmt.Errorf("failed to set rejected commit: %w", err)
+	}
+	return nil
+}
+
+// config returns the value of a section.key config key, or an empty string.
+func (r *goRepo) config(name string) (string, error) {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return "", err
+	}
+
+	section, key, _ := strings.Cut(name, ".")
+	return cfg.Raw.Section(section).Option(key), nil
+}
+
+// setConfig sets a section.key config key, an empty value removes it.
+func (r *goRepo) setConfig(name, value string) error {
+	cfg, err := r.repo.Config()
+	if err != nil {
+		return err
+	}
+
+	section, key, _ := strings.Cut(name, ".")
+	if value == "" {
+		cfg.Raw.Section(section).RemoveOption(key)
+	} else {
+		cfg.Raw.Section(section).SetOption(key, value)
+	}
+
+	return r.repo.SetConfig(cfg)
+}
@@ -0,0 +1,441 @@
+package git
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshSignatureHeader = "-----BEGIN SSH SIGNATURE-----"
+
+func (r *goRepo) VerifyCommits(keys *TrustedKeys, from, to string) error {
+	commits, err := r.commitsBetween(from, to)
+	if err != nil {
+		return err
+	}
+
+	gpgKeys, err := keys.gpgKeyRing()
+	if err != nil {
+		return err
+	}
+
+	sshKeys, err := keys.sshKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, commit := range commits {
+		if err := verifyCommit(commit, gpgKeys, sshKeys); err != nil {
+			return &ErrUntrusted{Commit: commit.Hash.String(), output: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// commitsBetween returns the commits in from..to, or just to if from is
+// empty, or not an ancestor of to.
+func (r *goRepo) commitsBetween(from, to string) ([]*object.Commit, error) {
+	toHash, err := r.resolve(to)
+	if err != nil {
+		return nil, &ErrUnknownRef{Ref: to, err: err}
+	}
+	toCommit, err := r.repo.CommitObject(toHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if from == "" {
+		return []*object.Commit{toCommit}, nil
+	}
+
+	fromHash, err := r.resolve(from)
+	if err != nil {
+		return nil, &ErrUnknownRef{Ref: from, err: err}
+	}
+	fromCommit, err := r.repo.CommitObject(fromHash)
+	if err != nil {
+		return nil, err
+	}
+
+	shallow, err := r.repo.Storer.Shallow()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shallow commits: %w", err)
+	}
+
+	commits, fromReached, err := walkBetween(fromCommit, toCommit, shallow)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits: %w", err)
+	}
+	if !fromReached {
+		return []*object.Commit{toCommit}, nil
+	}
+	return commits, nil
+}
+
+// Marks of commits walked by walkBetween.
+const (
+	reachableFromFrom = 1 << iota
+	reachableFromTo
+)
+
+// walkBetween returns commits reachable from to, but not from from, like
+// git rev-list from..to, and whether from is reachable from to. Commits are
+// walked from the newest, and the walk stops once every commit left is
+// reachable from from, so only the history between the two commits is read.
+// With skewed commit times, some commits may be returned although they are
+// reachable from from, they are verified needlessly then. The history of a
+// shallow repository ends at its shallow commits, whose parents are missing.
+func walkBetween(from, to *object.Commit, shallow []plumbing.Hash) ([]*object.Commit, bool, error) {
+	marks := map[plumbing.Hash]int{}
+	queue := &commitQueue{}
+	// pending counts queued commits that were reachable only from to when they were queued.
+	pending := 0
+
+	push := func(c *object.Commit, mark int) {
+		if marks[c.Hash]|mark == marks[c.Hash] {
+			return
+		}
+		marks[c.Hash] |= mark
+
+		interesting := marks[c.Hash] == reachableFromTo
+		if interesting {
+			pending++
+		}
+		heap.Push(queue, queuedCommit{commit: c, interesting: interesting})
+	}
+
+	push(from, reachableFromFrom)
+	push(to, reachableFromTo)
+
+	var candidates []*object.Commit
+	for pending > 0 {
+		q := heap.Pop(queue).(queuedCommit)
+		if q.interesting {
+			pending--
+		}
+
+		c := q.commit
+		mark := marks[c.Hash]
+		if mark == reachableFromTo {
+			candidates = append(candidates, c)
+		}
+
+		if slices.Contains(shallow, c.Hash) {
+			continue
+		}
+
+		err := c.Parents().ForEach(func(p *object.Commit) error {
+			push(p, mark)
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var commits []*object.Commit
+	seen := map[plumbing.Hash]bool{}
+	for _, c := range candidates {
+		if marks[c.Hash] == reachableFromTo && !seen[c.Hash] {
+			seen[c.Hash] = true
+			commits = append(commits, c)
+		}
+	}
+
+	return commits, marks[from.Hash]&reachableFromTo != 0, nil
+}
+
+type queuedCommit struct {
+	commit      *object.Commit
+	interesting bool
+}
+
+// commitQueue is a heap of commits, the newest by committer time first.
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].commit.Committer.When.After(q[j].commit.Committer.When)
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+func verifyCommit(commit *object.Commit, gpgKeys openpgp.EntityList, sshKeys []allowedSigner) error {
+	if commit.PGPSignature == "" {
+		return errors.New("commit is not signed")
+	}
+
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return err
+	}
+	reader, err := encoded.Reader()
+	if err != nil {
+		return err
+	}
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(commit.PGPSignature, sshSignatureHeader) {
+		return verifySSHSignature(payload, commit.PGPSignature, sshKeys, commit.Committer.When)
+	}
+
+	if len(gpgKeys) == 0 {
+		return errors.New("no trusted GPG keys")
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(gpgKeys, bytes.NewReader(payload), strings.NewReader(commit.PGPSignature), nil); err != nil {
+		return fmt.Errorf("bad GPG signature: %w", err)
+	}
+	return nil
+}
+
+// verifySSHSignature verifies an armored signature in the SSHSIG format of
+// ssh-keygen, with the namespace git uses. Like git, the validity of the key
+// is checked at the time the commit was made.
+func verifySSHSignature(payload []byte, armored string, trusted []allowedSigner, signedAt time.Time) error {
+	body := strings.TrimSpace(armored)
+	body = strings.TrimPrefix(body, sshSignatureHeader)
+	body = strings.TrimSuffix(body, "-----END SSH SIGNATURE-----")
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return fmt.Errorf("malformed SSH signature: %w", err)
+	}
+
+	if !bytes.HasPrefix(blob, []byte("SSHSIG")) {
+		return errors.New("malformed SSH signature")
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob[len("SSHSIG"):], &sig); err != nil {
+		return fmt.Errorf("malformed SSH signature: %w", err)
+	}
+	if sig.Version != 1 {
+		return fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	}
+	if sig.Namespace != "git" {
+		return fmt.Errorf("SSH signature has namespace %s instead of git", sig.Namespace)
+	}
+
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return fmt.Errorf("malformed SSH signature key: %w", err)
+	}
+
+	// The same key may be listed several times with different restrictions.
+	trustErr := fmt.Errorf("SSH key %s is not trusted", ssh.FingerprintSHA256(key))
+	for _, t := range trusted {
+		if !bytes.Equal(t.key.Marshal(), key.Marshal()) {
+			continue
+		}
+		if trustErr = t.allows(sig.Namespace, signedAt); trustErr == nil {
+			break
+		}
+	}
+	if trustErr != nil {
+		return trustErr
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported SSH signature hash %s", sig.HashAlgorithm)
+	}
+	h.Write(payload)
+
+	signed := []byte("SSHSIG")
+	signed = append(signed, ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return fmt.Errorf("malformed SSH signature: %w", err)
+	}
+
+	// Like ssh-keygen, refuse RSA signatures with SHA-1.
+	if key.Type() == ssh.KeyAlgoRSA && signature.Format != ssh.KeyAlgoRSASHA256 && signature.Format != ssh.KeyAlgoRSASHA512 {
+		return fmt.Errorf("unsupported SSH signature algorithm %s", signature.Format)
+	}
+
+	if err := key.Verify(signed, &signature); err != nil {
+		return fmt.Errorf("bad SSH signature: %w", err)
+	}
+	return nil
+}
+
+func (k *TrustedKeys) gpgKeyRing() (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+
+	for _, p := range k.gpgKeys {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted GPG key: %w", err)
+		}
+
+		var entities openpgp.EntityList
+		if strings.HasSuffix(p, ".asc") {
+			entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		} else {
+			entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse trusted GPG key %s: %w", p, err)
+		}
+		keyring = append(keyring, entities...)
+	}
+
+	return keyring, nil
+}
+
+// allowedSigner is a key of the allowed signers file, with the restrictions
+// of its options.
+type allowedSigner struct {
+	key ssh.PublicKey
+	// namespaces are patterns of signature namespaces the key may sign,
+	// patterns starting with ! exclude namespaces. Empty allows all.
+	namespaces []string
+	// validAfter and validBefore limit when the key may sign, if set.
+	validAfter, validBefore time.Time
+}
+
+// allows reports whether the signer may sign in namespace at the given time.
+func (s allowedSigner) allows(namespace string, at time.Time) error {
+	if len(s.namespaces) > 0 {
+		allowed := false
+		for _, pattern := range s.namespaces {
+			negated := strings.HasPrefix(pattern, "!")
+			if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), namespace); !ok {
+				continue
+			}
+			if negated {
+				allowed = false
+				break
+			}
+			allowed = true
+		}
+		if !allowed {
+			return fmt.Errorf("SSH key %s may not sign in namespace %s", ssh.FingerprintSHA256(s.key), namespace)
+		}
+	}
+
+	if !s.validAfter.IsZero() && at.Before(s.validAfter) {
+		return fmt.Errorf("SSH key %s is valid only after %s", ssh.FingerprintSHA256(s.key), s.validAfter)
+	}
+	if !s.validBefore.IsZero() && !at.Before(s.validBefore) {
+		return fmt.Errorf("SSH key %s is valid only before %s", ssh.FingerprintSHA256(s.key), s.validBefore)
+	}
+	return nil
+}
+
+// sshKeys parses the allowed signers file. Principals are ignored, as commits
+// are not tied to an identity. The namespaces, valid-after and valid-before
+// options are honored, certificate authorities are not supported.
+func (k *TrustedKeys) sshKeys() ([]allowedSigner, error) {
+	if k.allowedSigners == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(k.allowedSigners)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allowed signers: %w", err)
+	}
+
+	var signers []allowedSigner
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The principals come first, the rest is in the authorized_keys format.
+		_, rest, _ := strings.Cut(line, " ")
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allowed signer %q: %w", line, err)
+		}
+
+		signer := allowedSigner{key: key}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			value = strings.Trim(value, `"`)
+
+			switch strings.ToLower(name) {
+			case "namespaces":
+				signer.namespaces = strings.Split(value, ",")
+			case "valid-after":
+				signer.validAfter, err = parseSignerTime(value)
+			case "valid-before":
+				signer.validBefore, err = parseSignerTime(value)
+			case "cert-authority":
+				err = errors.New("certificate authorities are not supported by the go git backend")
+			default:
+				err = fmt.Errorf("unknown option %s", name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse allowed signer %q: %w", line, err)
+			}
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// parseSignerTime parses a time of the allowed signers file, YYYYMMDD or
+// YYYYMMDDHHMM[SS], in the local time zone unless it ends with Z.
+func parseSignerTime(value string) (time.Time, error) {
+	loc := time.Local
+	if v, ok := strings.CutSuffix(value, "Z"); ok {
+		value = v
+		loc = time.UTC
+	}
+
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) != len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s", value)
+}
@@ -0,0 +1,75 @@
+package git
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// ResolveTarget resolves the ref orches follows to a commit. The ref is
+// either empty for the upstream of the cloned branch, a branch of origin, a
+// tag, a commit, or a tag glob like v* that resolves to the tag with the
+// highest semantic version.
+func ResolveTarget(r Repo, ref string) (string, error) {
+	if ref == "" {
+		commit, err := r.Ref("@{u}")
+		if err != nil {
+			return "", fmt.Errorf("failed to get upstream ref (@{u}): %w. Ensure your current branch is tracking an upstream branch", err)
+		}
+		return commit, nil
+	}
+
+	if strings.ContainsAny(ref, "*?[") {
+		tag, err := highestTag(r, ref)
+		if err != nil {
+			return "", err
+		}
+		return r.Ref("refs/tags/" + tag + "^{commit}")
+	}
+
+	for _, candidate := range []string{"refs/remotes/origin/" + ref, "refs/tags/" + ref, ref} {
+		if commit, err := r.Ref(candidate + "^{commit}"); err == nil {
+			return commit, nil
+		}
+	}
+
+	return "", fmt.Errorf("ref %s is neither a branch of origin, a tag, nor a commit", ref)
+}
+
+// highestTag returns the tag matching the glob with the highest semantic
+// version. Tags that are not semantic versions are ignored.
+func highestTag(r Repo, glob string) (string, error) {
+	tags, err := r.Tags()
+	if err != nil {
+		return "", err
+	}
+
+	var highest, highestVersion string
+	for _, tag := range tags {
+		if ok, err := path.Match(glob, tag); err != nil {
+			return "", fmt.Errorf("invalid tag glob %s: %w", glob, err)
+		} else if !ok {
+			continue
+		}
+
+		version := tag
+		if !strings.HasPrefix(version, "v") {
+			version = "v" + version
+		}
+		if !semver.IsValid(version) {
+			continue
+		}
+
+		if highest == "" || semver.Compare(version, highestVersion) > 0 {
+			highest, highestVersion = tag, version
+		}
+	}
+
+	if highest == "" {
+		return "", fmt.Errorf("no tag matching %s is a semantic version", glob)
+	}
+
+	return highest, nil
+}
@@ -0,0 +1,258 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errSymlinkOutside is returned when a symlink points outside of the tree.
+var errSymlinkOutside = errors.New("symlink points outside of the tree")
+
+// treeEntry is a file, symlink or directory of a tree.
+type treeEntry struct {
+	mode fs.FileMode
+	hash string
+}
+
+// treeFS implements fs.FS over the files of a commit. Only the listing of
+// the tree is held in memory, contents and sizes are read from the object
+// storage on demand. In a partial clone, that is when missing blobs are
+// fetched.
+type treeFS struct {
+	entries map[string]treeEntry
+	// children holds names of entries of every directory.
+	children map[string][]string
+	read     func(hash string) ([]byte, error)
+	size     func(hash string) (int64, error)
+
+	// prefetch, if set, downloads objects of a partial clone in advance.
+	prefetch   func(hashes []string) error
+	prefetched map[string]bool
+}
+
+func newTreeFS(read func(hash string) ([]byte, error), size func(hash string) (int64, error)) *treeFS {
+	return &treeFS{
+		entries:  map[string]treeEntry{".": {mode: fs.ModeDir | 0755}},
+		children: map[string][]string{".": nil},
+		read:     read,
+		size:     size,
+
+		prefetched: map[string]bool{},
+	}
+}
+
+// add adds an entry with its path relative to the root of the tree. Parent
+// directories are added implicitly.
+func (t *treeFS) add(name string, mode fs.FileMode, hash string) {
+	if _, exists := t.entries[name]; exists {
+		return
+	}
+
+	t.entries[name] = treeEntry{mode: mode, hash: hash}
+	if mode.IsDir() {
+		t.children[name] = nil
+	}
+
+	dir := path.Dir(name)
+	t.add(dir, fs.ModeDir|0755, "")
+	t.children[dir] = append(t.children[dir], path.Base(name))
+}
+
+// resolve follows symlinks in name. Symlinks must stay within the tree.
+func (t *treeFS) resolve(op, name string) (string, treeEntry, error) {
+	if !fs.ValidPath(name) {
+		return "", treeEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	resolved := "."
+	parts := strings.Split(name, "/")
+	for hops := 0; len(parts) > 0; {
+		if parts[0] == "." {
+			parts = parts[1:]
+			continue
+		}
+
+		p := path.Join(resolved, parts[0])
+		entry, exists := t.entries[p]
+		if !exists {
+			return "", treeEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		if entry.mode.Type() != fs.ModeSymlink {
+			resolved, parts = p, parts[1:]
+			continue
+		}
+
+		if hops++; hops > 40 {
+			return "", treeEntry{}, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+
+		target, err := t.read(entry.hash)
+		if err != nil {
+			return "", treeEntry{}, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		rest := path.Join(append([]string{path.Dir(p), string(target)}, parts[1:]...)...)
+		if path.IsAbs(string(target)) || !fs.ValidPath(rest) {
+			return "", treeEntry{}, &fs.PathError{Op: op, Path: name, Err: errSymlinkOutside}
+		}
+		resolved, parts = ".", strings.Split(rest, "/")
+	}
+
+	return resolved, t.entries[resolved], nil
+}
+
+// Prefetch downloads the named files in one go, instead of one by one when
+// they are read. Unknown names, and files downloaded before are skipped.
+func (t *treeFS) Prefetch(names []string) error {
+	if t.prefetch == nil {
+		return nil
+	}
+
+	var hashes []string
+	for _, name := range names {
+		_, entry, err := t.resolve("prefetch", name)
+		if err != nil || entry.mode.IsDir() || t.prefetched[entry.hash] {
+			continue
+		}
+		t.prefetched[entry.hash] = true
+		hashes = append(hashes, entry.hash)
+	}
+
+	if len(hashes) == 0 {
+		return nil
+	}
+	return t.prefetch(hashes)
+}
+
+func (t *treeFS) Open(name string) (fs.File, error) {
+	resolved, entry, err := t.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &treeFileInfo{name: path.Base(name), entry: entry, tree: t}
+	if entry.mode.IsDir() {
+		entries, err := t.readDir(resolved)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &treeDir{info: info, entries: entries}, nil
+	}
+
+	data, err := t.read(entry.hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &treeFile{info: info, Reader: bytes.NewReader(data)}, nil
+}
+
+func (t *treeFS) ReadFile(name string) ([]byte, error) {
+	_, entry, err := t.resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+
+	data, err := t.read(entry.hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (t *treeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, entry, err := t.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return t.readDir(resolved)
+}
+
+// readDir lists the entries of the directory dir, without following
+// symlinks.
+func (t *treeFS) readDir(dir string) ([]fs.DirEntry, error) {
+	names := slices.Sorted(slices.Values(t.children[dir]))
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, name := range names {
+		entry := t.entries[path.Join(dir, name)]
+		entries = append(entries, fs.FileInfoToDirEntry(&treeFileInfo{name: name, entry: entry, tree: t}))
+	}
+	return entries, nil
+}
+
+type treeFileInfo struct {
+	name  string
+	entry treeEntry
+	tree  *treeFS
+}
+
+func (i *treeFileInfo) Name() string       { return i.name }
+func (i *treeFileInfo) Mode() fs.FileMode  { return i.entry.mode }
+func (i *treeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i *treeFileInfo) IsDir() bool        { return i.entry.mode.IsDir() }
+func (i *treeFileInfo) Sys() any           { return nil }
+
+// Size returns the size of the object. It is looked up only when needed,
+// and it is zero if the lookup fails.
+func (i *treeFileInfo) Size() int64 {
+	if i.entry.mode.IsDir() {
+		return 0
+	}
+
+	size, err := i.tree.size(i.entry.hash)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+type treeFile struct {
+	*bytes.Reader
+	info *treeFileInfo
+}
+
+func (f *treeFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *treeFile) Close() error               { return nil }
+
+type treeDir struct {
+	info    *treeFileInfo
+	entries []fs.DirEntry
+}
+
+func (d *treeDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *treeDir) Close() error               { return nil }
+
+func (d *treeDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *treeDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
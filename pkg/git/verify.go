@@ -0,0 +1,68 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// AllowedSignersFile is the name of the file with trusted SSH keys in the
+// trusted keys directory. It uses the format of ssh-keygen(1).
+const AllowedSignersFile = "allowed_signers"
+
+// TrustedKeys holds the keys that commits must be signed with.
+type TrustedKeys struct {
+	// allowedSigners is the path of the SSH allowed signers file, if any.
+	allowedSigners string
+
+	// gpgKeys are paths of armored, or binary GPG public keys.
+	gpgKeys []string
+}
+
+// LoadTrustedKeys loads trusted keys from dir. SSH keys are read from the
+// allowed_signers file, GPG keys from *.asc and *.gpg files. It returns nil
+// if dir does not exist, which disables signature verification.
+func LoadTrustedKeys(dir string) (*TrustedKeys, error) {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+
+	keys := &TrustedKeys{}
+
+	allowedSigners := path.Join(dir, AllowedSignersFile)
+	if _, err := os.Stat(allowedSigners); err == nil {
+		keys.allowedSigners = allowedSigners
+	}
+
+	for _, pattern := range []string{"*.asc", "*.gpg"} {
+		matches, err := filepath.Glob(path.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		keys.gpgKeys = append(keys.gpgKeys, matches...)
+	}
+
+	if keys.allowedSigners == "" && len(keys.gpgKeys) == 0 {
+		return nil, fmt.Errorf("no trusted keys found in %s", dir)
+	}
+
+	return keys, nil
+}
+
+// ErrUntrusted is returned when a commit is not signed by a trusted key.
+type ErrUntrusted struct {
+	Commit string
+	output string
+}
+
+func (e *ErrUntrusted) Error() string {
+	msg := fmt.Sprintf("commit %s is not signed by a trusted key", e.Commit)
+	if e.output != "" {
+		msg += ": " + e.output
+	}
+	return msg
+}
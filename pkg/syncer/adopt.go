@@ -0,0 +1,98 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// UnmanagedUnit is a unit from the repository whose install path, or the
+// install path of one of its drop-ins or auxiliary files, is already taken by
+// a file that orches does not own.
+type UnmanagedUnit struct {
+	Name     string `json:"name" yaml:"name"`
+	RepoPath string `json:"repoPath" yaml:"repoPath"`
+	Path     string `json:"path" yaml:"path"`
+
+	// Files are auxiliary files of the unit, relative to its directory.
+	Files []string `json:"files,omitempty" yaml:"files,omitempty"`
+
+	// Diff is a unified diff from the installed files to their repository
+	// versions. It is empty if they are identical.
+	Diff string `json:"diff" yaml:"diff"`
+}
+
+// FindUnmanaged returns units of the tree that are not owned according to the
+// manifest, but whose install path, or the install path of one of their
+// files, already exists. Without a manifest, no unit is owned.
+func FindUnmanaged(tree fs.FS, manifest *Manifest) ([]UnmanagedUnit, error) {
+	units, err := listUnits(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list units: %w", err)
+	}
+
+	user := os.Getuid() != 0
+
+	var unmanaged []UnmanagedUnit
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		u := units[name]
+		if manifest != nil && manifest.owns(name) {
+			continue
+		}
+
+		// Repository paths of the unit and its files, keyed by their install path.
+		files := map[string]string{u.Path(user): u.RepoPath()}
+		for _, f := range u.Files() {
+			files[path.Join(path.Dir(u.Path(user)), f)] = path.Join(path.Dir(u.RepoPath()), f)
+		}
+
+		raw := u.Raw()
+
+		var diff strings.Builder
+		exists := false
+		for _, dst := range slices.Sorted(maps.Keys(files)) {
+			ud := difflib.UnifiedDiff{
+				B:        splitLines(raw[files[dst]]),
+				FromFile: "/dev/null",
+				ToFile:   files[dst],
+				Context:  3,
+			}
+
+			installed, err := os.ReadFile(dst)
+			if err == nil {
+				exists = true
+				ud.A = splitLines(string(installed))
+				ud.FromFile = dst
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+
+			d, err := difflib.GetUnifiedDiffString(ud)
+			if err != nil {
+				return nil, fmt.Errorf("failed to diff %s: %w", name, err)
+			}
+			diff.WriteString(d)
+		}
+
+		if !exists {
+			continue
+		}
+
+		unmanaged = append(unmanaged, UnmanagedUnit{
+			Name:     name,
+			RepoPath: u.RepoPath(),
+			Path:     u.Path(user),
+			Files:    u.Files(),
+			Diff:     diff.String(),
+		})
+	}
+
+	return unmanaged, nil
+}
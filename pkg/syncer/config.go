@@ -0,0 +1,73 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the name of the optional orches configuration file stored
+// in the root of the repository.
+const ConfigFile = "orches.yaml"
+
+type repoConfig struct {
+	// Directories lists patterns of directories that are searched for units.
+	// A pattern ending with /** also matches all subdirectories.
+	Directories []string `yaml:"directories"`
+}
+
+func loadConfig(tree fs.FS) (*repoConfig, error) {
+	cfg := &repoConfig{Directories: []string{"."}}
+
+	data, err := fs.ReadFile(tree, ConfigFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ConfigFile, err)
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ConfigFile, err)
+	}
+
+	for _, pattern := range cfg.Directories {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+			return nil, fmt.Errorf("invalid directory pattern %q in %s: %w", pattern, ConfigFile, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// includesDir reports whether units in dir, relative to the repository
+// root, should be processed.
+func (c *repoConfig) includesDir(dir string) bool {
+	for _, pattern := range c.Directories {
+		pattern = path.Clean(pattern)
+		if pattern == "**" {
+			return true
+		}
+
+		if prefix, recursive := strings.CutSuffix(pattern, "/**"); recursive {
+			for d := dir; ; d = path.Dir(d) {
+				if ok, _ := path.Match(prefix, d); ok {
+					return true
+				}
+				if d == "." {
+					break
+				}
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(pattern, dir); ok {
+			return true
+		}
+	}
+
+	return false
+}
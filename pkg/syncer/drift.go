@@ -0,0 +1,156 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/orches-team/orches/pkg/unit"
+	"github.com/orches-team/orches/pkg/utils"
+)
+
+// Drift returns units of the deployed tree whose installed files no longer
+// match the repository, e.g. because they were edited by hand. The result
+// maps unit names to a description of the drift.
+func Drift(tree fs.FS) (map[string]string, error) {
+	units, err := listUnits(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list units: %w", err)
+	}
+
+	s := &Syncer{User: os.Getuid() != 0}
+
+	drift := make(map[string]string)
+	for _, u := range units {
+		if err := s.checkInstalled(u); err != nil {
+			drift[u.Name()] = err.Error()
+		}
+	}
+
+	return drift, nil
+}
+
+// Reconcile restores the repository version of all drifted units of the
+// deployed tree, and restarts them. Units that were not
+// installed at all are started, unless they are activated by a trigger.
+// It returns the drift that was found, and whether orches itself drifted
+// and must be restarted.
+func Reconcile(tree fs.FS, dryRun bool) (map[string]string, bool, error) {
+	units, err := listUnits(tree)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list units: %w", err)
+	}
+
+	s := &Syncer{
+		Dry:  dryRun,
+		User: os.Getuid() != 0,
+	}
+
+	drift := make(map[string]string)
+	var modified, missing []unit.Unit
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		u := units[name]
+		if err := s.checkInstalled(u); err != nil {
+			drift[u.Name()] = err.Error()
+			if _, err := os.Stat(u.Path(s.User)); errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, u)
+			} else {
+				modified = append(modified, u)
+			}
+		}
+	}
+
+	if len(drift) == 0 {
+		return drift, false, nil
+	}
+
+	drifted := append(slices.Clone(modified), missing...)
+
+	// orches cannot restart itself, just like in a sync.
+	isOrches := func(u unit.Unit) bool { return u.Name() == "orches.container" }
+	restartNeeded := slices.ContainsFunc(modified, isOrches)
+	modified = slices.DeleteFunc(modified, isOrches)
+
+	graph, err := newDepGraph(units)
+	if err != nil {
+		return drift, false, err
+	}
+
+	if err := s.CreateDirs(); err != nil {
+		return drift, false, fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	if err := s.Add(tree, drifted); err != nil {
+		return drift, false, fmt.Errorf("failed to restore units: %w", err)
+	}
+
+	if err := s.ReloadDaemon(); err != nil {
+		return drift, false, fmt.Errorf("failed to reload daemon: %w", err)
+	}
+
+	if err := graph.inOrder(modified, false, s.RestartUnits); err != nil {
+		return drift, false, fmt.Errorf("failed to restart units: %w", err)
+	}
+
+	activated := activatedUnits(units)
+	toStart := utils.FilterSlice(missing, func(u unit.Unit) bool { return !slices.Contains(activated, u.SystemctlName()) })
+	if err := graph.inOrder(toStart, false, s.StartUnits); err != nil {
+		return drift, false, fmt.Errorf("failed to start units: %w", err)
+	}
+
+	if err := s.EnableUnits(toStart); err != nil {
+		return drift, false, fmt.Errorf("failed to enable units: %w", err)
+	}
+
+	return drift, restartNeeded, nil
+}
+
+// checkInstalled compares the installed unit and its auxiliary files with
+// their copies in the repository.
+func (s *Syncer) checkInstalled(u unit.Unit) error {
+	data, err := os.ReadFile(u.Path(s.User))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("unit is not installed")
+	} else if err != nil {
+		return err
+	}
+
+	parsed, err := unit.Parse(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse installed unit: %w", err)
+	}
+	if !parsed.Equal(u.Parsed()) {
+		return errors.New("installed unit differs from the repository")
+	}
+
+	snapshot := u.Snapshot()
+	for _, f := range u.Files() {
+		installed := path.Join(path.Dir(u.Path(s.User)), f)
+		data, err := os.ReadFile(installed)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s is not installed", f)
+		} else if err != nil {
+			return err
+		}
+
+		content := string(data)
+		// Drop-ins are stored in their canonical form.
+		if path.Ext(f) == ".conf" {
+			parsed, err := unit.Parse(content)
+			if err != nil {
+				return fmt.Errorf("failed to parse installed %s: %w", f, err)
+			}
+			content = parsed.String()
+		}
+
+		if content != snapshot[path.Join(path.Dir(u.RepoPath()), f)] {
+			return fmt.Errorf("installed %s differs from the repository", f)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/orches-team/orches/pkg/unit"
+	"github.com/orches-team/orches/pkg/utils"
+)
+
+// Health checks are polled every healthPollInterval at first, the interval
+// doubles up to healthPollMaxInterval.
+const (
+	healthPollInterval    = time.Second
+	healthPollMaxInterval = 15 * time.Second
+)
+
+// ErrUnhealthy is returned when units do not become healthy in time.
+type ErrUnhealthy struct {
+	timeout time.Duration
+
+	// Units holds the last health check error, keyed by unit name.
+	Units map[string]error
+}
+
+func (e *ErrUnhealthy) Error() string {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(e.Units)) {
+		errs = append(errs, fmt.Errorf("%s: %w", name, e.Units[name]))
+	}
+	return fmt.Sprintf("units not healthy after %s: %v", e.timeout, errors.Join(errs...))
+}
+
+// WaitHealthy waits until all units are active, and all containers with a
+// healthcheck report being healthy. It fails if any unit does not get
+// healthy within the timeout.
+func (s *Syncer) WaitHealthy(units []unit.Unit, timeout time.Duration) error {
+	if s.Dry || len(units) == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	interval := healthPollInterval
+	pending := units
+
+	for {
+		// Units that exit right after starting are still active when systemctl start returns, so even
+		// the first check waits.
+		time.Sleep(min(interval, time.Until(deadline)))
+		interval = min(2*interval, healthPollMaxInterval)
+
+		errs := s.checkHealth(pending)
+		unhealthy := slices.DeleteFunc(append([]unit.Unit{}, pending...), func(u unit.Unit) bool { return errs[u.Name()] == nil })
+
+		if len(unhealthy) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &ErrUnhealthy{timeout: timeout, Units: errs}
+		}
+
+		slog.Debug("Waiting for units to become healthy", "units", utils.MapSlice(unhealthy, func(u unit.Unit) string { return u.Name() }))
+		pending = unhealthy
+	}
+}
+
+// checkHealth returns why each of the units is not healthy yet, keyed by unit
+// name. Healthy units are left out.
+func (s *Syncer) checkHealth(units []unit.Unit) map[string]error {
+	errs := make(map[string]error)
+
+	// Container names, mapped to the names of their units.
+	containers := make(map[string]string)
+	for _, u := range units {
+		if err := s.checkActive(u); err != nil {
+			errs[u.Name()] = err
+			continue
+		}
+
+		if u.Typ() == unit.UnitTypeContainer {
+			containers[containerName(u)] = u.Name()
+		}
+	}
+
+	if len(containers) == 0 {
+		return errs
+	}
+
+	names := slices.Sorted(maps.Keys(containers))
+	statuses, err := s.containerHealth(names)
+	for _, name := range names {
+		status, exists := statuses[name]
+		switch {
+		case err != nil:
+			errs[containers[name]] = err
+		case !exists:
+			errs[containers[name]] = fmt.Errorf("container %s does not exist", name)
+		// Containers without a healthcheck report an empty status.
+		case status != "" && status != "healthy":
+			errs[containers[name]] = fmt.Errorf("container %s is %s", name, status)
+		}
+	}
+
+	return errs
+}
+
+// checkActive checks that the unit is running. Only oneshot services are
+// done when they exit, other units, especially containers, must stay active.
+func (s *Syncer) checkActive(u unit.Unit) error {
+	props, err := s.unitProperties(u, "ActiveState", "Result", "Type")
+	if err != nil {
+		return err
+	}
+
+	switch state := props["ActiveState"]; {
+	case state == "active":
+		return nil
+	case state == "inactive" && props["Type"] == "oneshot" && props["Result"] == "success":
+		return nil
+	default:
+		return fmt.Errorf("unit is %s (result: %s)", state, props["Result"])
+	}
+}
+
+// containerName returns the name of the container that Quadlet creates for
+// the unit.
+func containerName(u unit.Unit) string {
+	if names := u.Values("Container", "ContainerName"); len(names) > 0 {
+		return names[len(names)-1]
+	}
+	return "systemd-" + strings.TrimSuffix(u.Name(), ".container")
+}
+
+// containerHealth returns the healthcheck status of the named containers,
+// keyed by name. It runs a single podman command on the host for all of them,
+// as orches may run in a container without podman.
+func (s *Syncer) containerHealth(names []string) (map[string]string, error) {
+	argv := []string{"/usr/bin/env", "podman", "container", "inspect", "--format", "{{.Name}}={{if .State.Health}}{{.State.Health.Status}}{{end}}"}
+	out, err := s.runTransient(append(argv, names...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect containers: %w", err)
+	}
+
+	statuses := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name, status, ok := strings.Cut(line, "="); ok {
+			statuses[name] = status
+		}
+	}
+	return statuses, nil
+}
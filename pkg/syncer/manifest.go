@@ -0,0 +1,205 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/orches-team/orches/pkg/unit"
+)
+
+// ManifestFile is the name of the manifest in the orches base directory.
+const ManifestFile = "manifest.json"
+
+// Manifest records the units deployed by the last successful sync. It is the
+// source of truth of what orches owns on the host, even if the repository
+// is force-pushed or its local checkout is lost.
+type Manifest struct {
+	Commit string         `json:"commit"`
+	Units  []ManifestUnit `json:"units"`
+}
+
+type ManifestUnit struct {
+	Name     string `json:"name"`
+	RepoPath string `json:"repoPath"`
+	Path     string `json:"path"`
+
+	// Files are auxiliary files deployed next to the unit, relative to its
+	// directory.
+	Files []string `json:"files,omitempty"`
+
+	// Hash is the hash of the unit's snapshot at the time of the deployment.
+	Hash string `json:"hash"`
+}
+
+// NewManifest creates a manifest of all units of the tree, deployed from the
+// given commit.
+func NewManifest(tree fs.FS, commit string) (*Manifest, error) {
+	units, err := listUnits(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list units: %w", err)
+	}
+
+	user := os.Getuid() != 0
+	m := &Manifest{Commit: commit, Units: []ManifestUnit{}}
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		u := units[name]
+		m.Units = append(m.Units, ManifestUnit{
+			Name:     u.Name(),
+			RepoPath: u.RepoPath(),
+			Path:     u.Path(user),
+			Files:    u.Files(),
+			Hash:     unitHash(u),
+		})
+	}
+
+	return m, nil
+}
+
+// LoadManifest loads the manifest stored at path. It returns nil if there is
+// no manifest yet.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+
+	return &m, nil
+}
+
+// Save atomically writes the manifest to path.
+func (m *Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// Adopt takes ownership of the given unmanaged units. Their installed copies
+// are used as their old state, so the next sync overwrites, and restarts
+// them only if they differ from the repository. Either way, they are started
+// and enabled like new units.
+func (m *Manifest) Adopt(units []UnmanagedUnit) {
+	for _, u := range units {
+		m.Units = append(m.Units, ManifestUnit{
+			Name:     u.Name,
+			RepoPath: u.RepoPath,
+			Path:     u.Path,
+			Files:    u.Files,
+		})
+	}
+}
+
+func (m *Manifest) owns(name string) bool {
+	return slices.ContainsFunc(m.Units, func(u ManifestUnit) bool { return u.Name == name })
+}
+
+// ownedUnits returns the units recorded in the manifest. Units that are
+// unchanged in the old repository tree are taken from it. The rest stand in
+// for the deployed version, which is compared by its recorded hash. Units
+// of the tree that are not in the manifest are not owned by orches, and are
+// left out.
+func (m *Manifest) ownedUnits(tree map[string]unit.Unit) map[string]unit.Unit {
+	owned := make(map[string]unit.Unit)
+
+	for _, entry := range m.Units {
+		if u, exists := tree[entry.Name]; exists && entry.Hash != "" && unitHash(u) == entry.Hash {
+			owned[entry.Name] = u
+			continue
+		}
+
+		u, err := deployedUnit(entry, tree)
+		if err != nil {
+			slog.Warn("Ignoring unit of unknown type in the manifest", "unit", entry.Name, "error", err)
+			continue
+		}
+		owned[entry.Name] = &ownedUnit{Unit: u, entry: entry}
+	}
+
+	return owned
+}
+
+// deployedUnit returns the best known version of a deployed unit that is
+// not in the old tree: its installed copy, its version from the tree, or an
+// empty unit. Only its dependencies and type are used, so that it is stopped
+// and removed in the right order.
+func deployedUnit(entry ManifestUnit, tree map[string]unit.Unit) (unit.Unit, error) {
+	u, err := unit.Installed(entry.Path, entry.RepoPath)
+	if err == nil {
+		return u, nil
+	}
+
+	if u, exists := tree[entry.Name]; exists {
+		slog.Warn("Failed to load installed unit, using the repository version", "unit", entry.Name, "error", err)
+		return u, nil
+	}
+
+	slog.Warn("Failed to load installed unit, using an empty one", "unit", entry.Name, "error", err)
+	return unit.Placeholder(entry.Name)
+}
+
+// ownedUnit is a deployed unit whose version is not in the old tree. Its
+// content is compared by the hash recorded in the manifest, and its files are
+// the ones recorded there.
+type ownedUnit struct {
+	unit.Unit
+	entry ManifestUnit
+}
+
+func (u *ownedUnit) EqualContent(other unit.Unit) bool {
+	// Adopted units have no recorded hash, their installed copy is compared.
+	if u.entry.Hash == "" {
+		return u.Unit.EqualContent(other)
+	}
+	return unitHash(other) == u.entry.Hash
+}
+
+func (u *ownedUnit) Files() []string {
+	return u.entry.Files
+}
+
+// isAdopted reports whether u is an adopted unit that was not deployed by a
+// sync yet.
+func isAdopted(u unit.Unit) bool {
+	o, ok := u.(*ownedUnit)
+	return ok && o.entry.Hash == ""
+}
+
+func unitHash(u unit.Unit) string {
+	snapshot := u.Snapshot()
+
+	h := sha256.New()
+	for _, p := range slices.Sorted(maps.Keys(snapshot)) {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+		h.Write([]byte(snapshot[p]))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,137 @@
+package syncer
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/orches-team/orches/pkg/unit"
+)
+
+// depGraph captures dependencies between managed units.
+type depGraph struct {
+	// depth is the length of the longest dependency chain of a unit, keyed
+	// by unit name. Units without dependencies have depth 0.
+	depth map[string]int
+}
+
+// dependencies returns references to other units, as they are written in
+// the unit. References can be unit names, or systemctl names.
+func dependencies(u unit.Unit) []string {
+	var refs []string
+
+	for _, key := range []string{"After", "Requires", "Wants"} {
+		for _, v := range u.Values("Unit", key) {
+			refs = append(refs, strings.Fields(v)...)
+		}
+	}
+
+	var section string
+	switch u.Typ() {
+	case unit.UnitTypeContainer:
+		section = "Container"
+	case unit.UnitTypePod:
+		section = "Pod"
+	case unit.UnitTypeKube:
+		section = "Kube"
+	default:
+		return refs
+	}
+
+	for _, key := range []string{"Network", "Pod", "Volume", "Image"} {
+		for _, v := range u.Values(section, key) {
+			ref, _, _ := strings.Cut(v, ":")
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs
+}
+
+// newDepGraph builds the dependency graph of units. Only references to
+// units from the given set are considered. It fails if the dependencies
+// contain a cycle.
+func newDepGraph(units map[string]unit.Unit) (*depGraph, error) {
+	byRef := make(map[string]unit.Unit)
+	for _, u := range units {
+		byRef[u.Name()] = u
+		byRef[u.SystemctlName()] = u
+	}
+
+	g := &depGraph{depth: make(map[string]int)}
+	visiting := make(map[string]bool)
+	var path []string
+
+	var visit func(u unit.Unit) error
+	visit = func(u unit.Unit) error {
+		if _, done := g.depth[u.Name()]; done {
+			return nil
+		}
+		if visiting[u.Name()] {
+			cycle := append(path[slices.Index(path, u.Name()):], u.Name())
+			return fmt.Errorf("dependency cycle between units: %s", strings.Join(cycle, " -> "))
+		}
+
+		visiting[u.Name()] = true
+		path = append(path, u.Name())
+
+		depth := 0
+		for _, ref := range dependencies(u) {
+			dep, exists := byRef[ref]
+			if !exists || dep.Name() == u.Name() {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+			depth = max(depth, g.depth[dep.Name()]+1)
+		}
+
+		path = path[:len(path)-1]
+		visiting[u.Name()] = false
+		g.depth[u.Name()] = depth
+		return nil
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		if err := visit(units[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// layers splits units into groups, so that units in each group depend only
+// on units from previous groups.
+func (g *depGraph) layers(units []unit.Unit) [][]unit.Unit {
+	var layers [][]unit.Unit
+
+	for _, u := range units {
+		depth := g.depth[u.Name()]
+		for len(layers) <= depth {
+			layers = append(layers, nil)
+		}
+		layers[depth] = append(layers[depth], u)
+	}
+
+	return slices.DeleteFunc(layers, func(l []unit.Unit) bool { return len(l) == 0 })
+}
+
+// inOrder calls fn for each layer of units, so that dependencies are
+// processed first. If reverse is set, dependents are processed first.
+func (g *depGraph) inOrder(units []unit.Unit, reverse bool, fn func([]unit.Unit) error) error {
+	layers := g.layers(units)
+	if reverse {
+		slices.Reverse(layers)
+	}
+
+	for _, layer := range layers {
+		if err := fn(layer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package syncer
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Plan describes changes that a sync between two trees would make.
+type Plan struct {
+	// From and To are the compared refs, they are informational only.
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	To   string `json:"to,omitempty" yaml:"to,omitempty"`
+
+	Added    []string `json:"added" yaml:"added"`
+	Removed  []string `json:"removed" yaml:"removed"`
+	Modified []string `json:"modified" yaml:"modified"`
+
+	// Diffs holds unified diffs of all changed files of modified units, as
+	// they are stored in the repository.
+	Diffs []FileDiff `json:"diffs" yaml:"diffs"`
+
+	// Actions lists commands the sync would run, in order.
+	Actions [][]string `json:"actions" yaml:"actions"`
+
+	// Refused explains why a sync would refuse to deploy the target, like
+	// an untrusted commit, or one that was rolled back before.
+	Refused string `json:"refused,omitempty" yaml:"refused,omitempty"`
+
+	// Unmanaged lists units whose install paths are taken by files orches
+	// does not own. A sync refuses to overwrite them until they are adopted.
+	Unmanaged []UnmanagedUnit `json:"unmanaged,omitempty" yaml:"unmanaged,omitempty"`
+}
+
+type FileDiff struct {
+	Path string `json:"path" yaml:"path"`
+	Diff string `json:"diff" yaml:"diff"`
+}
+
+// PlanTrees computes the plan of syncing from oldTree, or the manifest if not
+// nil, to newTree without changing anything on the system.
+func PlanTrees(oldTree, newTree fs.FS, manifest *Manifest) (*Plan, error) {
+	oldUnits, err := loadOldUnits(oldTree, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	newUnits, err := listUnits(newTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list new files: %w", err)
+	}
+
+	added, removed, modified := diffUnits(oldUnits, newUnits)
+
+	p := &Plan{
+		Added:    unitNames(added),
+		Removed:  unitNames(removed),
+		Modified: unitNames(modified),
+	}
+
+	for _, name := range p.Modified {
+		diffs, err := diffSnapshots(oldUnits[name].Raw(), newUnits[name].Raw())
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %s: %w", name, err)
+		}
+		p.Diffs = append(p.Diffs, diffs...)
+	}
+
+	s := &Syncer{
+		Dry:    true,
+		User:   os.Getuid() != 0,
+		Record: func(cmd []string) { p.Actions = append(p.Actions, cmd) },
+	}
+
+	if _, err := processChanges(s, newTree, oldUnits, newUnits, added, removed, modified, 0, nil); err != nil {
+		return nil, fmt.Errorf("failed to plan changes: %w", err)
+	}
+
+	return p, nil
+}
+
+func diffSnapshots(old, new map[string]string) ([]FileDiff, error) {
+	var diffs []FileDiff
+
+	paths := slices.Sorted(maps.Keys(old))
+	for p := range maps.Keys(new) {
+		if _, exists := old[p]; !exists {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+
+	for _, p := range paths {
+		if old[p] == new[p] {
+			continue
+		}
+
+		ud := difflib.UnifiedDiff{FromFile: "/dev/null", ToFile: "/dev/null", Context: 3}
+		if content, exists := old[p]; exists {
+			ud.A = splitLines(content)
+			ud.FromFile = "a/" + p
+		}
+		if content, exists := new[p]; exists {
+			ud.B = splitLines(content)
+			ud.ToFile = "b/" + p
+		}
+
+		diff, err := difflib.GetUnifiedDiffString(ud)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, FileDiff{Path: p, Diff: diff})
+	}
+
+	return diffs, nil
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// String renders the plan in a human-readable form.
+func (p *Plan) String() string {
+	var b strings.Builder
+
+	section := func(title, marker string, names []string) {
+		if len(names) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "%s:\n", title)
+		for _, name := range names {
+			fmt.Fprintf(&b, "  %s %s\n", marker, name)
+		}
+		b.WriteString("\n")
+	}
+
+	if p.From != "" || p.To != "" {
+		fmt.Fprintf(&b, "Plan: %s -> %s\n\n", p.From, p.To)
+	}
+
+	if p.Refused != "" {
+		fmt.Fprintf(&b, "Refused: %s\n\n", p.Refused)
+	}
+
+	if len(p.Unmanaged) > 0 {
+		b.WriteString("Unmanaged, adopt them with orches adopt:\n")
+		for _, u := range p.Unmanaged {
+			fmt.Fprintf(&b, "  ! %s (%s)\n", u.Name, u.Path)
+		}
+		b.WriteString("\n")
+	}
+
+	if len(p.Added) == 0 && len(p.Removed) == 0 && len(p.Modified) == 0 {
+		b.WriteString("No changes.\n")
+		return b.String()
+	}
+
+	section("Added", "+", p.Added)
+	section("Removed", "-", p.Removed)
+	section("Modified", "~", p.Modified)
+
+	for _, d := range p.Diffs {
+		b.WriteString(d.Diff)
+		b.WriteString("\n")
+	}
+
+	if len(p.Actions) > 0 {
+		b.WriteString("Actions:\n")
+		for _, a := range p.Actions {
+			fmt.Fprintf(&b, "  %s\n", strings.Join(a, " "))
+		}
+	}
+
+	return b.String()
+}
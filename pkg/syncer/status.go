@@ -0,0 +1,86 @@
+package syncer
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/orches-team/orches/pkg/unit"
+	"github.com/orches-team/orches/pkg/utils"
+)
+
+// UnitStatus describes the state of a unit deployed from the repository.
+type UnitStatus struct {
+	Name          string `json:"name" yaml:"name"`
+	RepoPath      string `json:"repoPath" yaml:"repoPath"`
+	Path          string `json:"path" yaml:"path"`
+	SystemctlName string `json:"systemctlName" yaml:"systemctlName"`
+
+	ActiveState  string `json:"activeState" yaml:"activeState"`
+	SubState     string `json:"subState" yaml:"subState"`
+	EnabledState string `json:"enabledState" yaml:"enabledState"`
+
+	// InSync is true when the installed unit and its auxiliary files match
+	// the repository. Drift describes the first difference otherwise.
+	InSync bool   `json:"inSync" yaml:"inSync"`
+	Drift  string `json:"drift,omitempty" yaml:"drift,omitempty"`
+}
+
+// UnitStatuses returns the status of all units of the deployed tree, sorted
+// by name.
+func UnitStatuses(tree fs.FS) ([]UnitStatus, error) {
+	units, err := listUnits(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list units: %w", err)
+	}
+
+	s := &Syncer{User: os.Getuid() != 0}
+
+	var statuses []UnitStatus
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		u := units[name]
+		status := UnitStatus{
+			Name:          u.Name(),
+			RepoPath:      u.RepoPath(),
+			Path:          u.Path(s.User),
+			SystemctlName: u.SystemctlName(),
+		}
+
+		props, err := s.unitProperties(u, "ActiveState", "SubState", "UnitFileState")
+		if err != nil {
+			slog.Warn("Failed to get state of unit", "unit", u.Name(), "error", err)
+			props = map[string]string{"ActiveState": "unknown", "SubState": "unknown", "UnitFileState": "unknown"}
+		}
+		status.ActiveState = props["ActiveState"]
+		status.SubState = props["SubState"]
+		status.EnabledState = props["UnitFileState"]
+
+		if err := s.checkInstalled(u); err != nil {
+			status.Drift = err.Error()
+		} else {
+			status.InSync = true
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func (s *Syncer) unitProperties(u unit.Unit, props ...string) (map[string]string, error) {
+	out, err := utils.ExecOutput(s.systemctlCmd("show", "--property="+strings.Join(props, ","), u.SystemctlName())...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		k, v, _ := strings.Cut(line, "=")
+		res[k] = v
+	}
+	return res, nil
+}
@@ -3,11 +3,15 @@ package syncer
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
+	"path"
 	"slices"
+	"strings"
+	"time"
 
-	// "github.com/orches-team/orches/pkg/git" // No longer needed here
 	"github.com/orches-team/orches/pkg/unit"
 	"github.com/orches-team/orches/pkg/utils"
 )
@@ -17,98 +21,382 @@ import (
 // state (like a git repository reset or directory removal) and should handle dryRun appropriately.
 type PostSyncAction func(dryRun bool) error
 
+// RepoDir is the location of the repository checkout of orches, it is set by
+// the caller. Units reference files of the repository by absolute paths into
+// it.
+var RepoDir string
+
+// ErrPartialSync is returned when a sync fails after it already started
+// changing the system, so the system is left partially synced.
+type ErrPartialSync struct {
+	err error
+}
+
+func (e *ErrPartialSync) Error() string {
+	return e.err.Error()
+}
+
+func (e *ErrPartialSync) Unwrap() error {
+	return e.err
+}
+
+// SyncResult describes the outcome of a sync. It is returned also when the
+// sync fails, as long as the changes were already computed.
 type SyncResult struct {
-	RestartNeeded bool
+	// From and To are the synced refs, they are informational only.
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	To   string `json:"to,omitempty" yaml:"to,omitempty"`
+
+	Added    []string `json:"added" yaml:"added"`
+	Removed  []string `json:"removed" yaml:"removed"`
+	Modified []string `json:"modified" yaml:"modified"`
+
+	// Restarted lists units that were restarted, including containers of
+	// restarted pods.
+	Restarted []string `json:"restarted" yaml:"restarted"`
+
+	RestartNeeded bool `json:"restartNeeded" yaml:"restartNeeded"`
+
+	// UnitErrors holds errors of individual units, keyed by unit name, like
+	// failures to stop, start or enable them, or failed health checks.
+	UnitErrors map[string]string `json:"unitErrors,omitempty" yaml:"unitErrors,omitempty"`
+	Error      string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func unitNames(units []unit.Unit) []string {
+	return slices.Sorted(slices.Values(utils.MapSlice(units, func(u unit.Unit) string { return u.Name() })))
 }
 
-func SyncDirs(
-	oldWorktreePath string,
-	newWorktreePath string,
+// SyncTrees syncs the system from the units in oldTree to the units in
+// newTree. If manifest is not nil, the units it records are used as the old
+// state instead.
+func SyncTrees(
+	oldTree fs.FS,
+	newTree fs.FS,
+	manifest *Manifest,
 	dryRun bool,
+	healthTimeout time.Duration,
 	postSyncAction PostSyncAction,
 ) (*SyncResult, error) {
-	oldUnits, err := listUnits(oldWorktreePath)
+	oldUnits, err := loadOldUnits(oldTree, manifest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list old files: %w", err)
+		return nil, err
 	}
 
-	newUnits, err := listUnits(newWorktreePath)
+	newUnits, err := listUnits(newTree)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list new files: %w", err)
 	}
 
 	added, removed, modified := diffUnits(oldUnits, newUnits)
 
-	res, err := processChanges(newWorktreePath, added, removed, modified, dryRun, postSyncAction)
+	s := &Syncer{
+		Dry:  dryRun,
+		User: os.Getuid() != 0,
+	}
+
+	res, err := processChanges(s, newTree, oldUnits, newUnits, added, removed, modified, healthTimeout, postSyncAction)
 	if err != nil {
-		return nil, fmt.Errorf("failed to process changes: %w", err)
+		err = fmt.Errorf("failed to process changes: %w", err)
+		res.Error = err.Error()
+		return res, err
 	}
 
 	return res, nil
 }
 
-func listUnits(dir string) (map[string]unit.Unit, error) {
-	files := make(map[string]unit.Unit)
-	entries, err := os.ReadDir(dir)
+// Rollback reverts a sync from the units of oldTree to the units of newTree
+// that failed halfway. The units are synced back to the ones
+// owned according to manifest, the manifest from before the sync, if not nil.
+// Every step is attempted even if some fail. Units of the new state that were
+// never installed are not touched, and adopted units are kept, as their
+// previous version was overwritten.
+func Rollback(
+	oldTree fs.FS,
+	newTree fs.FS,
+	manifest *Manifest,
+	healthTimeout time.Duration,
+	postSyncAction PostSyncAction,
+) (*SyncResult, error) {
+	oldUnits, err := loadOldUnits(oldTree, manifest)
 	if err != nil {
 		return nil, err
 	}
-	for _, entry := range entries {
-		if entry.IsDir() {
+
+	newUnits, err := listUnits(newTree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list new files: %w", err)
+	}
+
+	user := os.Getuid() != 0
+	deployed := make(map[string]unit.Unit)
+	for name, u := range newUnits {
+		// The previous version of an adopted unit was overwritten, so the new one is kept.
+		if old, exists := oldUnits[name]; exists && isAdopted(old) {
+			oldUnits[name] = u
+			deployed[name] = u
+			continue
+		}
+
+		if _, err := os.Stat(u.Path(user)); err == nil {
+			deployed[name] = u
+		}
+	}
+
+	added, removed, modified := diffUnits(deployed, oldUnits)
+
+	s := &Syncer{
+		User:       user,
+		BestEffort: true,
+	}
+
+	res, err := processChanges(s, oldTree, deployed, oldUnits, added, removed, modified, healthTimeout, postSyncAction)
+	if err != nil {
+		err = fmt.Errorf("failed to process changes: %w", err)
+		res.Error = err.Error()
+		return res, err
+	}
+
+	return res, nil
+}
+
+func loadOldUnits(tree fs.FS, manifest *Manifest) (map[string]unit.Unit, error) {
+	units, err := listUnits(tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list old files: %w", err)
+	}
+
+	if manifest != nil {
+		units = manifest.ownedUnits(units)
+	}
+
+	return units, nil
+}
+
+// isDropinDir reports whether rel holds drop-ins of a unit next to it, like
+// foo.container.d of foo.container. Other directories ending in .d may hold
+// units.
+func isDropinDir(tree fs.FS, rel string) bool {
+	name, ok := strings.CutSuffix(rel, ".d")
+	if !ok || !unit.IsUnit(name) {
+		return false
+	}
+
+	info, err := fs.Stat(tree, name)
+	return err == nil && !info.IsDir()
+}
+
+// prefetcher is implemented by trees that can download files in advance,
+// like trees of partial clones.
+type prefetcher interface {
+	Prefetch(names []string) error
+}
+
+// prefetchUnits downloads units and their drop-ins at once if the tree
+// supports it. Files that fail to download are fetched again when read.
+func prefetchUnits(tree fs.FS, paths []string) {
+	p, ok := tree.(prefetcher)
+	if !ok {
+		return
+	}
+
+	var names []string
+	for _, rel := range paths {
+		if !unit.IsUnit(rel) {
 			continue
 		}
+		names = append(names, rel)
+		dropins, _ := fs.ReadDir(tree, rel+".d")
+		for _, d := range dropins {
+			if !d.IsDir() && path.Ext(d.Name()) == ".conf" {
+				names = append(names, path.Join(rel+".d", d.Name()))
+			}
+		}
+	}
+
+	if err := p.Prefetch(names); err != nil {
+		slog.Warn("Failed to prefetch units", "error", err)
+	}
+}
+
+func listUnits(tree fs.FS) (map[string]unit.Unit, error) {
+	cfg, err := loadConfig(tree)
+	if err != nil {
+		return nil, err
+	}
 
-		u, err := unit.New(dir, entry.Name())
+	var paths []string
+	err = fs.WalkDir(tree, ".", func(rel string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			// Skip hidden directories (like .git), and drop-in directories that are loaded with their unit.
+			if rel != "." && (strings.HasPrefix(entry.Name(), ".") || isDropinDir(tree, rel)) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if cfg.includesDir(path.Dir(rel)) {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefetchUnits(tree, paths)
+
+	files := make(map[string]unit.Unit)
+	for _, rel := range paths {
+		u, err := unit.New(tree, rel, RepoDir)
 		var e *unit.ErrUnknownUnitType
 		if errors.As(err, &e) {
-			slog.Info("Skipping unknown unit type", "unit", entry.Name())
+			slog.Info("Skipping unknown unit type", "unit", rel)
 			continue
 		} else if err != nil {
 			return nil, err
 		}
 
-		files[entry.Name()] = u
+		if other, exists := files[u.Name()]; exists {
+			return nil, fmt.Errorf("unit %s is defined twice: in %s and in %s", u.Name(), other.RepoPath(), rel)
+		}
+
+		files[u.Name()] = u
 	}
-	return files, err
+
+	return files, nil
 }
 
 func diffUnits(old, new map[string]unit.Unit) (added, removed, changed []unit.Unit) {
-	for file, u := range old {
-		if _, exists := new[file]; !exists {
-			removed = append(removed, u)
+	// Units are sorted by name, so that plans and syncs are reproducible.
+	for _, name := range slices.Sorted(maps.Keys(old)) {
+		if _, exists := new[name]; !exists {
+			removed = append(removed, old[name])
 		}
 	}
-	for file, u := range new {
-		if _, exists := old[file]; !exists {
+	for _, name := range slices.Sorted(maps.Keys(new)) {
+		u := new[name]
+		if oldU, exists := old[name]; !exists {
 			added = append(added, u)
-		}
-	}
-	for file, u := range new {
-		if oldU, exists := old[file]; exists && !u.EqualContent(oldU) {
+		} else if !oldU.EqualContent(u) {
 			changed = append(changed, u)
+		} else if isAdopted(oldU) {
+			// Adopted units may have never been started or enabled, they are deployed like new ones.
+			added = append(added, u)
 		}
 	}
 
 	return
 }
 
+// podMembers returns all containers from units that belong to one of the
+// modified pods and that are not already part of the changed set.
+func podMembers(units map[string]unit.Unit, changed, modified []unit.Unit) []unit.Unit {
+	var members []unit.Unit
+
+	for _, pod := range modified {
+		if pod.Typ() != unit.UnitTypePod {
+			continue
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(units)) {
+			u := units[name]
+			if u.Typ() != unit.UnitTypeContainer || !slices.Contains(u.Values("Container", "Pod"), pod.Name()) {
+				continue
+			}
+			if slices.ContainsFunc(changed, func(c unit.Unit) bool { return c.Name() == u.Name() }) {
+				continue
+			}
+			members = append(members, u)
+		}
+	}
+
+	return members
+}
+
+// activatedUnits returns systemctl names of all units activated by one of
+// the given timer, socket or path units.
+func activatedUnits(units map[string]unit.Unit) []string {
+	var activated []string
+
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		if name := units[name].Activates(); name != "" {
+			activated = append(activated, name)
+		}
+	}
+
+	return activated
+}
+
+// changedImages returns modified containers whose Image= key changed.
+func changedImages(oldUnits map[string]unit.Unit, modified []unit.Unit) []unit.Unit {
+	var containers []unit.Unit
+
+	for _, u := range modified {
+		if u.Typ() != unit.UnitTypeContainer {
+			continue
+		}
+
+		oldU, exists := oldUnits[u.Name()]
+		if !exists {
+			continue
+		}
+
+		image := u.Values("Container", "Image")
+		if len(image) == 0 || slices.Equal(image, oldU.Values("Container", "Image")) {
+			continue
+		}
+
+		containers = append(containers, u)
+	}
+
+	return containers
+}
+
 func processChanges(
-	newDir string, // This is newWorktreePath
+	s *Syncer,
+	newTree fs.FS,
+	oldUnits, newUnits map[string]unit.Unit,
 	added, removed, modified []unit.Unit,
-	dryRun bool,
+	healthTimeout time.Duration,
 	postSyncAction PostSyncAction,
 ) (*SyncResult, error) {
+	res := &SyncResult{
+		Added:    unitNames(added),
+		Removed:  unitNames(removed),
+		Modified: unitNames(modified),
+	}
+
 	if len(added) == 0 && len(removed) == 0 && len(modified) == 0 {
 		fmt.Fprintf(os.Stderr, "No changes to process.")
 		// Execute postSyncAction even if no unit changes, as the underlying repo might have changed.
 		if postSyncAction != nil {
-			if err := postSyncAction(dryRun); err != nil {
-				return nil, fmt.Errorf("post sync action failed even with no unit changes: %w", err)
+			if err := postSyncAction(s.Dry); err != nil {
+				return res, fmt.Errorf("post sync action failed even with no unit changes: %w", err)
 			}
 		}
-		return &SyncResult{}, nil
+		return res, nil
 	}
 
+	// A cycle in the deployed units must not prevent replacing them, stop them unordered instead.
+	oldGraph, err := newDepGraph(oldUnits)
+	if err != nil {
+		slog.Warn("Cannot order deployed units, stopping them in parallel", "error", err)
+		oldGraph = &depGraph{depth: make(map[string]int)}
+	}
+
+	newGraph, err := newDepGraph(newUnits)
+	if err != nil {
+		return res, fmt.Errorf("failed to order new units: %w", err)
+	}
+
+	// Restarting a pod tears down all its containers, so they have to be restarted as well.
+	modified = append(modified, podMembers(newUnits, append(added, modified...), modified)...)
+
 	if len(added) > 0 {
 		fmt.Fprintf(os.Stderr, "Added: %v\n", utils.MapSlice(added, func(u unit.Unit) string { return u.Name() }))
 	}
@@ -119,73 +407,129 @@ func processChanges(
 		fmt.Fprintf(os.Stderr, "Modified: %v\n", utils.MapSlice(modified, func(u unit.Unit) string { return u.Name() }))
 	}
 
-	s := Syncer{
-		Dry:  dryRun,
-		User: os.Getuid() != 0,
-	}
-
 	isOrches := func(u unit.Unit) bool { return u.Name() == "orches.container" }
 
-	restartNeeded := false
-
 	toRestart := modified
 	toStop := removed
 	if slices.ContainsFunc(modified, isOrches) {
 		toRestart = slices.DeleteFunc(append([]unit.Unit{}, modified...), isOrches)
-		fmt.Println("orches.container was changed")
-		restartNeeded = true
+		fmt.Fprintln(os.Stderr, "orches.container was changed")
+		res.RestartNeeded = true
 	} else if slices.ContainsFunc(removed, isOrches) {
 		toStop = slices.DeleteFunc(append([]unit.Unit{}, removed...), isOrches)
-		fmt.Println("orches.container was removed")
-		restartNeeded = true
+		fmt.Fprintln(os.Stderr, "orches.container was removed")
+		res.RestartNeeded = true
 	}
 
+	res.Restarted = unitNames(toRestart)
+
+	// Errors of units that failed to stop, start, be enabled or get healthy are reported individually.
+	defer func() {
+		res.UnitErrors = s.unitErrors
+	}()
+
 	if err := s.CreateDirs(); err != nil {
-		return nil, fmt.Errorf("failed to create directories: %w", err)
+		return res, fmt.Errorf("failed to create directories: %w", err)
 	}
 
-	if err := s.DisableUnits(removed); err != nil {
-		return nil, fmt.Errorf("failed to disable unit: %w", err)
+	// From here on, the system is being changed, so errors leave it partially synced. A best-effort
+	// syncer goes on with the remaining steps, and returns all errors at the end.
+	var errs []error
+	partial := func(err error, format string) error {
+		if err == nil {
+			return nil
+		}
+		err = &ErrPartialSync{err: fmt.Errorf(format, err)}
+		if s.BestEffort {
+			errs = append(errs, err)
+			return nil
+		}
+		return err
+	}
+
+	if err := partial(s.DisableUnits(removed), "failed to disable unit: %w"); err != nil {
+		return res, err
+	}
+
+	if err := partial(oldGraph.inOrder(toStop, true, s.StopUnits), "failed to stop unit: %w"); err != nil {
+		return res, err
 	}
 
-	if err := s.StopUnits(toStop); err != nil {
-		return nil, fmt.Errorf("failed to stop unit: %w", err)
+	if err := partial(s.Remove(removed), "failed to remove unit: %w"); err != nil {
+		return res, err
 	}
 
-	if err := s.Remove(removed); err != nil {
-		return nil, fmt.Errorf("failed to remove unit: %w", err)
+	if err := partial(s.RemoveStaleFiles(oldUnits, modified), "failed to remove stale files: %w"); err != nil {
+		return res, err
 	}
 
-	if err := s.Add(newDir, append(added, modified...)); err != nil {
-		return nil, fmt.Errorf("failed to add unit: %w", err)
+	if err := partial(s.Add(newTree, append(added, modified...)), "failed to add unit: %w"); err != nil {
+		return res, err
 	}
 
-	if err := s.ReloadDaemon(); err != nil {
-		return nil, fmt.Errorf("failed to reload daemon: %w", err)
+	if err := partial(s.ReloadDaemon(), "failed to reload daemon: %w"); err != nil {
+		return res, err
 	}
 
 	// Perform the post-sync action (e.g., git reset, directory removal)
 	if postSyncAction != nil {
 		slog.Info("Executing post-sync action")
-		if err := postSyncAction(s.Dry); err != nil { // Pass syncer's dryRun state
-			return nil, fmt.Errorf("post-sync action failed: %w", err)
+		if err := partial(postSyncAction(s.Dry), "post-sync action failed: %w"); err != nil { // Pass syncer's dryRun state
+			return res, err
 		}
 		slog.Info("Post-sync action completed successfully")
 	} else {
 		slog.Info("No post-sync action provided")
 	}
 
-	if err := s.RestartUnits(toRestart); err != nil {
-		return nil, fmt.Errorf("failed to restart unit: %w", err)
+	// Images have to be pulled or built before the containers using them are restarted.
+	isImage := func(u unit.Unit) bool {
+		return u.Typ() == unit.UnitTypeImage || u.Typ() == unit.UnitTypeBuild
 	}
 
-	if err := s.StartUnits(append(added, toRestart...)); err != nil {
-		return nil, fmt.Errorf("failed to start unit: %w", err)
+	if err := partial(newGraph.inOrder(utils.FilterSlice(toRestart, isImage), false, s.RestartUnits), "failed to restart image unit: %w"); err != nil {
+		return res, err
 	}
 
-	if err := s.EnableUnits(added); err != nil {
-		return nil, fmt.Errorf("failed to enable unit: %w", err)
+	// Pull new images upfront, so the containers are down only for the time it takes to start them.
+	s.PullImages(changedImages(oldUnits, toRestart))
+
+	if err := partial(newGraph.inOrder(slices.DeleteFunc(append([]unit.Unit{}, toRestart...), isImage), false, s.RestartUnits), "failed to restart unit: %w"); err != nil {
+		return res, err
+	}
+
+	// Units activated by a managed timer, socket or path unit must only be started by their trigger.
+	activated := activatedUnits(newUnits)
+	isActivated := func(u unit.Unit) bool { return slices.Contains(activated, u.SystemctlName()) }
+
+	toStart := slices.DeleteFunc(append(append([]unit.Unit{}, added...), toRestart...), isActivated)
+
+	if err := partial(newGraph.inOrder(toStart, false, s.StartUnits), "failed to start unit: %w"); err != nil {
+		return res, err
+	}
+
+	// A zero timeout disables health gating.
+	if healthTimeout > 0 {
+		err := s.WaitHealthy(toStart, healthTimeout)
+		var unhealthy *ErrUnhealthy
+		if errors.As(err, &unhealthy) {
+			for name, err := range unhealthy.Units {
+				s.unitError(name, err)
+			}
+		}
+		if err := partial(err, "health check failed: %w"); err != nil {
+			return res, err
+		}
+	}
+
+	// Modified adopted units may have never been enabled either.
+	toEnable := append(append([]unit.Unit{}, added...), slices.DeleteFunc(append([]unit.Unit{}, modified...), func(u unit.Unit) bool {
+		return !isAdopted(oldUnits[u.Name()])
+	})...)
+
+	if err := partial(s.EnableUnits(slices.DeleteFunc(toEnable, isActivated)), "failed to enable unit: %w"); err != nil {
+		return res, err
 	}
 
-	return &SyncResult{RestartNeeded: restartNeeded}, nil
+	return res, errors.Join(errs...)
 }
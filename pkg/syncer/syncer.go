@@ -3,9 +3,12 @@ package syncer
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
+	"slices"
+	"strings"
 
 	"github.com/orches-team/orches/pkg/unit"
 	"github.com/orches-team/orches/pkg/utils"
@@ -14,6 +17,25 @@ import (
 type Syncer struct {
 	Dry  bool
 	User bool
+
+	// Record, if set, is called with every command the syncer runs, or would
+	// run in the dry mode.
+	Record func(cmd []string)
+
+	// BestEffort makes a sync go on after a step fails, e.g. for rollbacks.
+	BestEffort bool
+
+	// unitErrors holds errors of units that failed to transition or to get
+	// healthy, keyed by unit name. systemctl does not tell which unit of a
+	// batch failed, so all of them get the error.
+	unitErrors map[string]string
+}
+
+func (s *Syncer) unitError(name string, err error) {
+	if s.unitErrors == nil {
+		s.unitErrors = make(map[string]string)
+	}
+	s.unitErrors[name] = err.Error()
 }
 
 func (s *Syncer) createDir(dir string) error {
@@ -23,6 +45,9 @@ func (s *Syncer) createDir(dir string) error {
 	}
 
 	s.dryPrint("Create", dir)
+	if s.Dry {
+		return nil
+	}
 
 	return os.MkdirAll(dir, 0755)
 }
@@ -41,14 +66,65 @@ func (s *Syncer) Remove(units []unit.Unit) error {
 	for _, u := range units {
 		s.dryPrint("remove", u.Path(s.User))
 		if !s.Dry {
-			errs = append(errs, os.Remove(u.Path(s.User)))
+			errs = append(errs, removeFile(u.Path(s.User)))
 		}
 
+		errs = append(errs, s.removeFiles(u, u.Files()))
 	}
 
 	return errors.Join(errs...)
 }
 
+// RemoveStaleFiles removes auxiliary files, like drop-ins, that the old
+// version of a unit had, but the new version no longer has.
+func (s *Syncer) RemoveStaleFiles(oldUnits map[string]unit.Unit, units []unit.Unit) error {
+	errs := []error{}
+
+	for _, u := range units {
+		oldU, exists := oldUnits[u.Name()]
+		if !exists {
+			continue
+		}
+
+		stale := slices.DeleteFunc(oldU.Files(), func(f string) bool { return slices.Contains(u.Files(), f) })
+		errs = append(errs, s.removeFiles(u, stale))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Syncer) removeFiles(u unit.Unit, files []string) error {
+	errs := []error{}
+	unitDir := path.Dir(u.Path(s.User))
+
+	for _, f := range files {
+		dst := path.Join(unitDir, f)
+		s.dryPrint("remove", dst)
+		if s.Dry {
+			continue
+		}
+		errs = append(errs, removeFile(dst))
+
+		// Clean up drop-in directories once they are empty.
+		if dir := path.Dir(dst); dir != unitDir {
+			if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+				errs = append(errs, os.Remove(dir))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// removeFile removes the file at p. A missing file is already removed, e.g.
+// when it was never installed.
+func removeFile(p string) error {
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
 func (s *Syncer) StopUnits(units []unit.Unit) error {
 	return s.transitionUnits("stop", units)
 }
@@ -77,19 +153,92 @@ func (s *Syncer) DisableUnits(units []unit.Unit) error {
 	return s.transitionUnits("disable", filtered)
 }
 
-func (s *Syncer) Add(srcDir string, units []unit.Unit) error {
+// Add installs the units and their auxiliary files from tree.
+func (s *Syncer) Add(tree fs.FS, units []unit.Unit) error {
 	errs := []error{}
 
 	for _, u := range units {
-		s.dryPrint("copy", path.Join(srcDir, u.Name()), u.Path(s.User))
+		s.dryPrint("copy", u.RepoPath(), u.Path(s.User))
 		if !s.Dry {
-			errs = append(errs, utils.CopyFile(path.Join(srcDir, u.Name()), u.Path(s.User)))
+			errs = append(errs, utils.CopyFile(tree, u.RepoPath(), u.Path(s.User)))
+		}
+
+		for _, f := range u.Files() {
+			src := path.Join(path.Dir(u.RepoPath()), f)
+			dst := path.Join(path.Dir(u.Path(s.User)), f)
+			s.dryPrint("copy", src, dst)
+			if !s.Dry {
+				errs = append(errs, os.MkdirAll(path.Dir(dst), 0755))
+				errs = append(errs, utils.CopyFile(tree, src, dst))
+			}
 		}
 	}
 
 	return errors.Join(errs...)
 }
 
+// PullImages makes sure the images of the given containers are present on
+// the host. Images managed by .image and .build units are pulled, or built by
+// starting their unit, other images are pulled by podman in a transient unit
+// with the Pull=, AuthFile=, Creds= and TLSVerify= keys of the container.
+// Pulling is best-effort, failures are logged, and left to the restart of the
+// container, which pulls again.
+func (s *Syncer) PullImages(containers []unit.Unit) {
+	seen := map[string]bool{}
+
+	for _, u := range containers {
+		image := lastValue(u, "Image")
+
+		if ext := path.Ext(image); ext == ".image" || ext == ".build" {
+			name := strings.TrimSuffix(image, ext) + "-" + ext[1:] + ".service"
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if err := s.runSystemctl("start", name); err != nil {
+				slog.Warn("Failed to start image unit in advance, it is started when the container restarts", "container", u.Name(), "unit", name, "error", err)
+			}
+			continue
+		}
+
+		cmd := []string{"/usr/bin/env", "podman", "pull"}
+		if policy := lastValue(u, "Pull"); policy != "" {
+			cmd = append(cmd, "--policy", policy)
+		}
+		if authFile := lastValue(u, "AuthFile"); authFile != "" {
+			cmd = append(cmd, "--authfile", authFile)
+		}
+		if creds := lastValue(u, "Creds"); creds != "" {
+			cmd = append(cmd, "--creds", creds)
+		}
+		if tlsVerify := lastValue(u, "TLSVerify"); tlsVerify != "" {
+			cmd = append(cmd, "--tls-verify="+tlsVerify)
+		}
+		cmd = append(cmd, image)
+
+		key := strings.Join(cmd, " ")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if _, err := s.runTransient(cmd...); err != nil {
+			slog.Warn("Failed to pull image in advance, it is pulled when the container restarts", "container", u.Name(), "image", image, "error", err)
+		}
+	}
+}
+
+// lastValue returns the value of the key in the [Container] section that
+// takes effect, the last one.
+func lastValue(u unit.Unit, key string) string {
+	values := u.Values("Container", key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
 func (s *Syncer) ReloadDaemon() error {
 	return s.runSystemctl("daemon-reload")
 }
@@ -107,16 +256,41 @@ func (s *Syncer) systemctlCmd(verb string, args ...string) []string {
 }
 
 func (s *Syncer) runSystemctl(verb string, args ...string) error {
-	cmd := s.systemctlCmd(verb, args...)
+	_, err := s.run(s.systemctlCmd(verb, args...))
+	return err
+}
+
+// run runs the command, unless in the dry mode.
+func (s *Syncer) run(cmd []string) ([]byte, error) {
 	s.dryPrint("Run", cmd)
+	if s.Record != nil {
+		s.Record(cmd)
+	}
+	if s.Dry {
+		return nil, nil
+	}
 
 	out, err := utils.ExecOutput(cmd...)
 
 	if len(out) > 0 {
-		slog.Debug("systemctl output", "output", string(out))
+		slog.Debug(fmt.Sprintf("%s output", cmd[0]), "output", string(out))
 	}
 
-	return err
+	return out, err
+}
+
+// runTransient runs the command on the host as a transient systemd unit and
+// waits for it to finish.
+func (s *Syncer) runTransient(argv ...string) ([]byte, error) {
+	cmd := []string{"systemd-run"}
+
+	if s.User {
+		cmd = append(cmd, "--user")
+	}
+
+	cmd = append(cmd, "--wait", "--collect", "--quiet", "--pipe")
+	cmd = append(cmd, argv...)
+	return s.run(cmd)
 }
 
 func (s *Syncer) transitionUnits(verb string, units []unit.Unit) error {
@@ -125,11 +299,17 @@ func (s *Syncer) transitionUnits(verb string, units []unit.Unit) error {
 	}
 
 	names := utils.MapSlice(units, func(u unit.Unit) string { return u.SystemctlName() })
-	return s.runSystemctl(verb, names...)
+	if err := s.runSystemctl(verb, names...); err != nil {
+		for _, u := range units {
+			s.unitError(u.Name(), fmt.Errorf("failed to %s: %w", verb, err))
+		}
+		return err
+	}
+	return nil
 }
 
 func (s *Syncer) dryPrint(action string, args ...any) {
-	if s.Dry {
+	if s.Dry && s.Record == nil {
 		fmt.Fprintf(os.Stderr, "%s: %v\n", action, args)
 	}
 	slog.Debug(fmt.Sprintf("syncer: %s", action), "args", args)
@@ -0,0 +1,133 @@
+package unit
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Entry is a single key assignment in a unit file.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// Section is a single section of a unit file.
+type Section struct {
+	Name    string
+	Entries []Entry
+}
+
+// UnitFile is a parsed systemd unit file.
+type UnitFile struct {
+	Sections []Section
+}
+
+// Parse parses a systemd unit file. Comments and empty lines are dropped,
+// and lines ending with a backslash are joined with the following line.
+func Parse(content string) (*UnitFile, error) {
+	f := &UnitFile{}
+	var section *Section
+
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(lines[i])
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section header: %s", lineNo, line)
+			}
+			f.Sections = append(f.Sections, Section{Name: line[1 : len(line)-1]})
+			section = &f.Sections[len(f.Sections)-1]
+			continue
+		}
+
+		// Continuation lines are joined by a space, comments inside them are skipped.
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			next := strings.TrimSpace(lines[i])
+			if strings.HasPrefix(next, "#") || strings.HasPrefix(next, ";") {
+				continue
+			}
+			line = strings.TrimSpace(strings.TrimSuffix(line, "\\")) + " " + next
+		}
+		line = strings.TrimSuffix(line, "\\")
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key=value: %s", lineNo, line)
+		}
+		if section == nil {
+			return nil, fmt.Errorf("line %d: assignment outside of a section: %s", lineNo, line)
+		}
+
+		section.Entries = append(section.Entries, Entry{
+			Key:   strings.TrimSpace(key),
+			Value: strings.TrimSpace(value),
+		})
+	}
+
+	return f, nil
+}
+
+// Values returns all values of the given key in the given section, in the
+// order they appear in the unit file.
+func (f *UnitFile) Values(section, key string) []string {
+	var values []string
+
+	for _, s := range f.Sections {
+		if s.Name != section {
+			continue
+		}
+		for _, e := range s.Entries {
+			if e.Key == key {
+				values = append(values, e.Value)
+			}
+		}
+	}
+
+	return values
+}
+
+// Equal reports whether both files are semantically equal, i.e. they differ
+// only in formatting, comments, or in the order of sections and keys.
+func (f *UnitFile) Equal(other *UnitFile) bool {
+	return f.String() == other.String()
+}
+
+// String returns the canonical form of the unit file. Sections with the same
+// name are merged, and sections and keys are sorted by name. The order of
+// values of a repeated key is preserved, as it is significant.
+func (f *UnitFile) String() string {
+	entries := make(map[string][]Entry)
+	for _, s := range f.Sections {
+		entries[s.Name] = append(entries[s.Name], s.Entries...)
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n", name)
+
+		sorted := slices.Clone(entries[name])
+		slices.SortStableFunc(sorted, func(a, b Entry) int { return strings.Compare(a.Key, b.Key) })
+		for _, e := range sorted {
+			fmt.Fprintf(&b, "%s=%s\n", e.Key, e.Value)
+		}
+	}
+
+	return b.String()
+}
@@ -2,8 +2,13 @@ package unit
 
 import (
 	"fmt"
+	"io/fs"
+	"maps"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 )
 
 var homeDir string
@@ -43,19 +48,53 @@ const (
 	UnitTypeContainer UnitType = iota
 	UnitTypeNetwork
 	UnitTypeService
+	UnitTypeVolume
+	UnitTypePod
+	UnitTypeKube
+	UnitTypeImage
+	UnitTypeBuild
+	UnitTypeTimer
+	UnitTypeSocket
+	UnitTypePath
+	UnitTypeTarget
 )
 
 type unit struct {
-	name    string
-	content string
+	name     string
+	repoPath string
+	parsed   *UnitFile
+
+	// files holds contents of auxiliary files deployed next to the unit, keyed
+	// by their path relative to the unit. Drop-ins are stored in their
+	// canonical form.
+	files map[string]string
+
+	// raw holds contents of the unit and its auxiliary files as they are
+	// stored in the repository, keyed by their path relative to the
+	// repository root.
+	raw map[string]string
+
+	// watched holds files from the repository that the unit declared as its
+	// dependencies via X-Orches-Watch=, keyed by their path relative to the
+	// repository root.
+	watched map[string]string
 }
 
 type Unit interface {
 	Name() string
+	RepoPath() string
 	SystemctlName() string
 	Path(user bool) string
+	Typ() UnitType
 	EqualContent(Unit) bool
+	Values(section, key string) []string
+	Parsed() *UnitFile
+	Files() []string
+	Watched() []string
+	Snapshot() map[string]string
+	Raw() map[string]string
 	CanBeEnabled() bool
+	Activates() string
 }
 
 type ErrUnknownUnitType struct {
@@ -66,26 +105,149 @@ func (e *ErrUnknownUnitType) Error() string {
 	return fmt.Sprintf("unknown unit type: %v", e.name)
 }
 
-func New(baseDir, name string) (Unit, error) {
-	data, err := os.ReadFile(path.Join(baseDir, name))
+// IsUnit reports whether name is the file name of a supported unit type.
+func IsUnit(name string) bool {
+	return (&unit{}).innerTyp(path.Base(name)) != nil
+}
+
+// New loads the unit stored at repoPath in fsys. The unit is named after the
+// file, the directory it is stored in is irrelevant. repoDir is the location
+// of the deployed repository checkout, units reference files of the
+// repository by absolute paths into it.
+func New(fsys fs.FS, repoPath, repoDir string) (Unit, error) {
+	u, err := load(fsys, repoPath)
 	if err != nil {
 		return nil, err
 	}
 
-	u := &unit{
-		name:    name,
-		content: string(data),
+	if err := u.loadWatched(fsys, repoDir); err != nil {
+		return nil, err
 	}
-	if u.innerTyp(name) == nil {
+	return u, nil
+}
+
+// Installed loads the installed copy of a unit at installPath, with the
+// drop-ins and files deployed next to it, as if it was stored at repoPath.
+// Watched files stay in the repository, so they are not loaded.
+func Installed(installPath, repoPath string) (Unit, error) {
+	u, err := load(os.DirFS(path.Dir(installPath)), path.Base(installPath))
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]string)
+	for p, content := range u.raw {
+		raw[path.Join(path.Dir(repoPath), p)] = content
+	}
+	u.repoPath = repoPath
+	u.raw = raw
+	u.watched = map[string]string{}
+	return u, nil
+}
+
+// Placeholder returns an empty unit named name. It stands in for a deployed
+// unit whose contents are unknown, so that it can still be stopped and
+// removed.
+func Placeholder(name string) (Unit, error) {
+	if !IsUnit(name) {
 		return nil, &ErrUnknownUnitType{name: name}
 	}
+
+	return &unit{
+		name:     name,
+		repoPath: name,
+		parsed:   &UnitFile{},
+		files:    map[string]string{},
+		raw:      map[string]string{},
+		watched:  map[string]string{},
+	}, nil
+}
+
+func load(fsys fs.FS, repoPath string) (*unit, error) {
+	name := path.Base(repoPath)
+	if !IsUnit(name) {
+		return nil, &ErrUnknownUnitType{name: repoPath}
+	}
+
+	data, err := fs.ReadFile(fsys, repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", repoPath, err)
+	}
+
+	u := &unit{
+		name:     name,
+		repoPath: repoPath,
+		parsed:   parsed,
+		raw:      map[string]string{repoPath: string(data)},
+	}
+
+	if err := u.loadFiles(fsys); err != nil {
+		return nil, err
+	}
 	return u, nil
 }
 
+func (u *unit) loadFiles(fsys fs.FS) error {
+	u.files = make(map[string]string)
+	unitDir := path.Dir(u.repoPath)
+
+	// Quadlet resolves relative Yaml= paths against the location of the unit,
+	// so the YAML file has to be deployed alongside it.
+	if u.Typ() == UnitTypeKube {
+		for _, yaml := range u.Values("Kube", "Yaml") {
+			if path.IsAbs(yaml) {
+				continue
+			}
+			if !filepath.IsLocal(yaml) {
+				return fmt.Errorf("yaml file %s of %s points outside of the unit directory", yaml, u.name)
+			}
+
+			data, err := fs.ReadFile(fsys, path.Join(unitDir, yaml))
+			if err != nil {
+				return fmt.Errorf("failed to read yaml file of %s: %w", u.name, err)
+			}
+			u.files[yaml] = string(data)
+			u.raw[path.Join(path.Dir(u.repoPath), yaml)] = string(data)
+		}
+	}
+
+	// Drop-ins live in a NAME.d directory next to the unit.
+	dropins, err := fs.Glob(fsys, path.Join(unitDir, u.name+".d", "*.conf"))
+	if err != nil {
+		return fmt.Errorf("failed to list drop-ins of %s: %w", u.name, err)
+	}
+	for _, dropin := range dropins {
+		data, err := fs.ReadFile(fsys, dropin)
+		if err != nil {
+			return fmt.Errorf("failed to read drop-in of %s: %w", u.name, err)
+		}
+
+		// Drop-ins are compared in their canonical form, just like units.
+		parsed, err := Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("failed to parse drop-in %s of %s: %w", path.Base(dropin), u.name, err)
+		}
+		u.files[path.Join(u.name+".d", path.Base(dropin))] = parsed.String()
+		u.raw[path.Join(path.Dir(u.repoPath), u.name+".d", path.Base(dropin))] = string(data)
+	}
+
+	return nil
+}
+
 func (u *unit) Name() string {
 	return u.name
 }
 
+// RepoPath returns the path of the unit relative to the repository root.
+func (u *unit) RepoPath() string {
+	return u.repoPath
+}
+
 func (u *unit) innerTyp(name string) *UnitType {
 	var typ UnitType
 
@@ -96,6 +258,24 @@ func (u *unit) innerTyp(name string) *UnitType {
 		typ = UnitTypeNetwork
 	case path.Ext(name) == ".service":
 		typ = UnitTypeService
+	case path.Ext(name) == ".volume":
+		typ = UnitTypeVolume
+	case path.Ext(name) == ".pod":
+		typ = UnitTypePod
+	case path.Ext(name) == ".kube":
+		typ = UnitTypeKube
+	case path.Ext(name) == ".image":
+		typ = UnitTypeImage
+	case path.Ext(name) == ".build":
+		typ = UnitTypeBuild
+	case path.Ext(name) == ".timer":
+		typ = UnitTypeTimer
+	case path.Ext(name) == ".socket":
+		typ = UnitTypeSocket
+	case path.Ext(name) == ".path":
+		typ = UnitTypePath
+	case path.Ext(name) == ".target":
+		typ = UnitTypeTarget
 	default:
 		return nil
 	}
@@ -113,8 +293,18 @@ func (u *unit) SystemctlName() string {
 		return u.name[:len(u.name)-len(".container")] + ".service"
 	case UnitTypeNetwork:
 		return u.name[:len(u.name)-len(".network")] + "-network.service"
-	case UnitTypeService:
+	case UnitTypeService, UnitTypeTimer, UnitTypeSocket, UnitTypePath, UnitTypeTarget:
 		return u.name
+	case UnitTypeVolume:
+		return u.name[:len(u.name)-len(".volume")] + "-volume.service"
+	case UnitTypePod:
+		return u.name[:len(u.name)-len(".pod")] + "-pod.service"
+	case UnitTypeKube:
+		return u.name[:len(u.name)-len(".kube")] + ".service"
+	case UnitTypeImage:
+		return u.name[:len(u.name)-len(".image")] + "-image.service"
+	case UnitTypeBuild:
+		return u.name[:len(u.name)-len(".build")] + "-build.service"
 	default:
 		panic("unknown unit type: " + u.name)
 	}
@@ -125,8 +315,18 @@ func (u *unit) Path(user bool) string {
 	case UnitTypeContainer:
 		fallthrough
 	case UnitTypeNetwork:
+		fallthrough
+	case UnitTypeVolume:
+		fallthrough
+	case UnitTypePod:
+		fallthrough
+	case UnitTypeKube:
+		fallthrough
+	case UnitTypeImage:
+		fallthrough
+	case UnitTypeBuild:
 		return path.Join(ContainerDir(user), u.name)
-	case UnitTypeService:
+	case UnitTypeService, UnitTypeTimer, UnitTypeSocket, UnitTypePath, UnitTypeTarget:
 		return path.Join(ServiceDir(user), u.name)
 	default:
 		panic("unknown unit type: " + u.name)
@@ -134,9 +334,93 @@ func (u *unit) Path(user bool) string {
 }
 
 func (u *unit) EqualContent(other Unit) bool {
-	return u.content == other.(*unit).content
+	o := other.(*unit)
+	return u.parsed.Equal(o.parsed) && maps.Equal(u.files, o.files) && maps.Equal(u.watched, o.watched)
+}
+
+// Snapshot returns contents of the unit, its auxiliary files and watched
+// files, keyed by their path relative to the repository root. The unit and
+// its drop-ins are in their canonical form.
+func (u *unit) Snapshot() map[string]string {
+	snapshot := map[string]string{u.repoPath: u.parsed.String()}
+	for f, content := range u.files {
+		snapshot[path.Join(path.Dir(u.repoPath), f)] = content
+	}
+	maps.Copy(snapshot, u.watched)
+	return snapshot
+}
+
+// Raw returns the same files as Snapshot, with the unit and its drop-ins as
+// they are stored in the repository.
+func (u *unit) Raw() map[string]string {
+	raw := maps.Clone(u.raw)
+	maps.Copy(raw, u.watched)
+	return raw
+}
+
+// Watched returns paths of watched files relative to the repository root.
+func (u *unit) Watched() []string {
+	return slices.Sorted(maps.Keys(u.watched))
+}
+
+// Files returns paths of auxiliary files that are deployed next to the unit.
+// The paths are relative to the unit's directory.
+func (u *unit) Files() []string {
+	return slices.Sorted(maps.Keys(u.files))
 }
 
 func (u *unit) CanBeEnabled() bool {
-	return u.Typ() == UnitTypeService
+	switch u.Typ() {
+	case UnitTypeService, UnitTypeTimer, UnitTypeSocket, UnitTypePath, UnitTypeTarget:
+		return true
+	default:
+		return false
+	}
+}
+
+// Activates returns the systemctl name of the unit activated by a timer,
+// socket or path unit. For all other units, it returns an empty string.
+func (u *unit) Activates() string {
+	var section, key string
+
+	switch u.Typ() {
+	case UnitTypeTimer:
+		section, key = "Timer", "Unit"
+	case UnitTypeSocket:
+		section, key = "Socket", "Service"
+	case UnitTypePath:
+		section, key = "Path", "Unit"
+	default:
+		return ""
+	}
+
+	if values := u.Values(section, key); len(values) > 0 {
+		return values[len(values)-1]
+	}
+
+	base := strings.TrimSuffix(u.name, path.Ext(u.name))
+	if accept := u.Values("Socket", "Accept"); u.Typ() == UnitTypeSocket && len(accept) > 0 &&
+		slices.Contains([]string{"yes", "true", "on", "1"}, strings.ToLower(accept[len(accept)-1])) {
+		return base + "@.service"
+	}
+	return base + ".service"
+}
+
+// Values returns all values of the given key in the given section, in the
+// order they appear in the unit file.
+func (u *unit) Values(section, key string) []string {
+	return u.parsed.Values(section, key)
+}
+
+func (u *unit) anySectionValues(key string) []string {
+	var values []string
+	for _, s := range u.parsed.Sections {
+		values = append(values, u.parsed.Values(s.Name, key)...)
+	}
+	return values
+}
+
+// Parsed returns the parsed content of the unit.
+func (u *unit) Parsed() *UnitFile {
+	return u.parsed
 }
@@ -0,0 +1,118 @@
+package unit
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WatchKey is the key listing files whose change should restart the unit.
+// It accepts space-separated glob patterns relative to the unit's directory,
+// and it can be used in any section of the unit.
+const WatchKey = "X-Orches-Watch"
+
+// loadWatched collects the files listed in X-Orches-Watch, and the files of
+// the repository the unit references by absolute paths into repoDir.
+func (u *unit) loadWatched(fsys fs.FS, repoDir string) error {
+	u.watched = make(map[string]string)
+
+	for _, value := range u.anySectionValues(WatchKey) {
+		for _, pattern := range strings.Fields(value) {
+			pattern = path.Join(path.Dir(u.repoPath), pattern)
+			if !filepath.IsLocal(pattern) {
+				return fmt.Errorf("watched file %s of %s points outside of the repository", pattern, u.name)
+			}
+
+			matches, err := fs.Glob(fsys, pattern)
+			if err != nil {
+				return fmt.Errorf("invalid watch pattern %s of %s: %w", pattern, u.name, err)
+			}
+
+			for _, match := range matches {
+				if err := u.watch(fsys, match); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Files from the repository referenced by the unit are watched implicitly.
+	for _, source := range u.sources() {
+		if repoDir == "" {
+			break
+		}
+
+		rel, err := filepath.Rel(repoDir, source)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+
+		if _, err := fs.Stat(fsys, rel); err != nil {
+			continue
+		}
+		if err := u.watch(fsys, rel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watch adds the file at rel in fsys to the watched files. If rel is a
+// directory, all files in it are watched.
+func (u *unit) watch(fsys fs.FS, rel string) error {
+	return fs.WalkDir(fsys, rel, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read watched file of %s: %w", u.name, err)
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return fmt.Errorf("failed to read watched file of %s: %w", u.name, err)
+		}
+
+		u.watched[p] = string(data)
+		return nil
+	})
+}
+
+// sources returns absolute paths of host files referenced by the unit, with
+// specifiers expanded.
+func (u *unit) sources() []string {
+	var sources []string
+
+	switch u.Typ() {
+	case UnitTypeContainer:
+		for _, v := range u.Values("Container", "Volume") {
+			src, _, _ := strings.Cut(v, ":")
+			sources = append(sources, src)
+		}
+		for _, v := range u.Values("Container", "EnvironmentFile") {
+			sources = append(sources, strings.TrimPrefix(v, "-"))
+		}
+	case UnitTypeKube:
+		sources = append(sources, u.Values("Kube", "ConfigMap")...)
+		sources = append(sources, u.Values("Kube", "Yaml")...)
+	}
+
+	var result []string
+	for _, src := range sources {
+		src = expandSpecifiers(src)
+		if path.IsAbs(src) {
+			result = append(result, path.Clean(src))
+		}
+	}
+
+	return result
+}
+
+// expandSpecifiers expands systemd specifiers that are commonly used in
+// paths.
+func expandSpecifiers(s string) string {
+	return strings.NewReplacer("%%", "%", "%h", homeDir).Replace(s)
+}
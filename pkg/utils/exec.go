@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -24,6 +25,24 @@ func execCommand(env []string, argv ...string) ([]byte, error) {
 	return out, nil
 }
 
+// ExecStdout executes a command and returns only its standard output. The
+// standard error is included in the returned error.
+func ExecStdout(argv ...string) ([]byte, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("no command provided")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("failed to execute command: %w\noutput:\n%s", err, stderr.String())
+	}
+	return out, nil
+}
+
 func ExecNoOutput(argv ...string) error {
 	_, err := execCommand(nil, argv...)
 	return err
@@ -3,11 +3,13 @@ package utils
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 )
 
-func CopyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
+// CopyFile copies the file at src in fsys to dst.
+func CopyFile(fsys fs.FS, src, dst string) error {
+	srcFile, err := fsys.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
 	}
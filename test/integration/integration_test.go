@@ -1,6 +1,10 @@
 package integration_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"os/exec"
@@ -13,6 +17,7 @@ import (
 	"github.com/orches-team/orches/pkg/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 var cid string
@@ -114,7 +119,7 @@ const testdir2 = "/orchestest2"
 
 func cleanup(t *testing.T) {
 	// ADD ALL UNITS USED IN TESTS HERE
-	for _, unit := range []string{"caddy", "caddy2", "orches"} {
+	for _, unit := range []string{"caddy", "caddy2", "orches", "data-volume", "web-pod", "web", "backup.timer", "caddy-image", "caddy-build"} {
 		runUnchecked("systemctl", "stop", unit)
 	}
 
@@ -402,3 +407,1477 @@ Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
 	err = cmd.Wait()
 	assert.NoError(t, err, "orches process should exit cleanly after prune")
 }
+
+func TestOrchesVolume(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "data.volume"), `[Volume]
+VolumeName=orches-data
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+Volume=data.volume:/data
+`)
+
+	runOrches(t, "init", testdir)
+
+	run(t, "ls", "/etc/containers/systemd/data.volume")
+
+	out := run(t, "systemctl", "status", "data-volume")
+	assert.Contains(t, string(out), "Active: active")
+
+	out = run(t, "podman", "volume", "ls", "--format", "{{.Name}}")
+	assert.Contains(t, string(out), "orches-data")
+
+	out = run(t, "systemctl", "status", "caddy")
+	assert.Contains(t, string(out), "Active: active (running)")
+
+	runOrches(t, "prune")
+
+	_, err := runUnchecked("ls", "/etc/containers/systemd/data.volume")
+	assert.Error(t, err)
+}
+
+// runsBefore asserts that the verbose output of orches runs the first command
+// before the second one.
+func runsBefore(t *testing.T, out, first, second string) {
+	i, j := strings.Index(out, first), strings.Index(out, second)
+	require.NotEqual(t, -1, i, out)
+	require.NotEqual(t, -1, j, out)
+	assert.Less(t, i, j, out)
+}
+
+func TestOrchesImage(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	// A changed image must be pulled before the container is restarted
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:2-alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	out := runOrches(t, "sync")
+	runsBefore(t, string(out), "podman pull docker.io/library/caddy:2-alpine", "try-restart caddy.service")
+
+	run(t, "podman", "image", "exists", "docker.io/library/caddy:2-alpine")
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// An image that only exists locally cannot be pulled, the container still restarts
+	run(t, "podman", "tag", "docker.io/library/caddy:alpine", "localhost/orches-caddy-local")
+	defer runUnchecked("podman", "rmi", "localhost/orches-caddy-local")
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=localhost/orches-caddy-local
+Pull=never
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "sync")
+	assert.Contains(t, string(out), "podman pull --policy never localhost/orches-caddy-local")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=localhost/orches-caddy-local:latest
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "sync")
+	assert.Contains(t, string(out), "Failed to pull image in advance")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// An image unit must be started before the container using it is restarted
+	addFile(t, filepath.Join(testdir, "caddy.image"), `[Image]
+Image=docker.io/library/caddy:alpine
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=caddy.image
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "sync")
+	runsBefore(t, string(out), "start caddy-image.service", "try-restart caddy.service")
+
+	out = run(t, "systemctl", "status", "caddy-image")
+	assert.Contains(t, string(out), "Active: active")
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// A build unit must build the image before the container using it is restarted
+	run(t, "mkdir", "-p", filepath.Join(testdir, "build"))
+	addFile(t, filepath.Join(testdir, "build", "Containerfile"), `FROM docker.io/library/caddy:alpine
+`)
+	addFile(t, filepath.Join(testdir, "caddy.build"), `[Build]
+ImageTag=localhost/orches-caddy
+SetWorkingDirectory=/var/lib/orches/repo/build
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=caddy.build
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "sync")
+	runsBefore(t, string(out), "start caddy-build.service", "try-restart caddy.service")
+
+	run(t, "podman", "image", "exists", "localhost/orches-caddy")
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesPod(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "web.pod"), `[Pod]
+PodName=web
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+Pod=web.pod
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "systemctl", "status", "web-pod")
+	assert.Contains(t, string(out), "Active: active")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	invocation := run(t, "systemctl", "show", "--value", "-p", "InvocationID", "caddy")
+
+	// Change only the pod, the container must be restarted together with it
+	addAndCommit(t, filepath.Join(testdir, "web.pod"), `[Pod]
+PodName=web
+Label=version=2
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "systemctl", "status", "caddy")
+	assert.Contains(t, string(out), "Active: active (running)")
+
+	out = run(t, "systemctl", "show", "--value", "-p", "InvocationID", "caddy")
+	assert.NotEqual(t, string(invocation), string(out))
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesKube(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	kubeYaml := `apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  hostNetwork: true
+  containers:
+    - name: caddy
+      image: docker.io/library/caddy:alpine
+      command: ["/usr/bin/caddy", "file-server", "--listen", ":%d", "--root", "/usr/share/caddy"]
+`
+
+	addFile(t, filepath.Join(testdir, "web.yaml"), fmt.Sprintf(kubeYaml, 8080))
+	addAndCommit(t, filepath.Join(testdir, "web.kube"), `[Kube]
+Yaml=web.yaml
+`)
+
+	runOrches(t, "init", testdir)
+
+	run(t, "ls", "/etc/containers/systemd/web.yaml")
+
+	out := run(t, "systemctl", "status", "web")
+	assert.Contains(t, string(out), "Active: active")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// Only change the YAML file, the kube unit must still be restarted
+	addAndCommit(t, filepath.Join(testdir, "web.yaml"), fmt.Sprintf(kubeYaml, 9090))
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	runOrches(t, "prune")
+
+	_, err := runUnchecked("ls", "/etc/containers/systemd/web.yaml")
+	assert.Error(t, err)
+}
+
+func TestOrchesTimer(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "backup.service"), `[Service]
+Type=oneshot
+ExecStart=/usr/bin/touch /tmp/orches-backup
+`)
+	addAndCommit(t, filepath.Join(testdir, "backup.timer"), `[Timer]
+OnCalendar=yearly
+
+[Install]
+WantedBy=timers.target
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "systemctl", "status", "backup.timer")
+	assert.Contains(t, string(out), "Active: active (waiting)")
+
+	out = run(t, "systemctl", "is-enabled", "backup.timer")
+	assert.Contains(t, string(out), "enabled")
+
+	// The service must only be activated by the timer
+	_, err := runUnchecked("ls", "/tmp/orches-backup")
+	assert.Error(t, err)
+
+	runOrches(t, "prune")
+
+	_, err = runUnchecked("ls", "/etc/systemd/system/backup.timer")
+	assert.Error(t, err)
+}
+
+func TestOrchesDropIn(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+`)
+	// Only directories named after a unit hold its drop-ins, units in other .d directories are deployed
+	run(t, "mkdir", "-p", filepath.Join(testdir, "caddy.container.d"), filepath.Join(testdir, "networks.d"))
+	addFile(t, filepath.Join(testdir, "orches.yaml"), `directories:
+  - "**"
+`)
+	addFile(t, filepath.Join(testdir, "networks.d", "web.network"), `[Network]
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container.d", "10-port.conf"), `[Container]
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	run(t, "ls", "/etc/containers/systemd/caddy.container.d/10-port.conf")
+	run(t, "ls", "/etc/containers/systemd/web.network")
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// Changing only the drop-in must restart the container
+	addAndCommit(t, filepath.Join(testdir, "caddy.container.d", "10-port.conf"), `[Container]
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	// Removing the drop-in must remove it from the host as well
+	run(t, "rm", "-rf", filepath.Join(testdir, "caddy.container.d"))
+	commit(t, testdir)
+
+	runOrches(t, "sync")
+
+	_, err := runUnchecked("ls", "/etc/containers/systemd/caddy.container.d")
+	assert.Error(t, err)
+}
+
+func TestOrchesDirectories(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", filepath.Join(testdir, "apps", "web"), filepath.Join(testdir, "ignored"))
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "orches.yaml"), `directories:
+  - apps/**
+`)
+	addFile(t, filepath.Join(testdir, "ignored", "caddy2.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	addAndCommit(t, filepath.Join(testdir, "apps", "web", "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	run(t, "ls", "/etc/containers/systemd/caddy.container")
+	_, err := runUnchecked("ls", "/etc/containers/systemd/caddy2.container")
+	assert.Error(t, err)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// A unit name used twice must fail the sync
+	addAndCommit(t, filepath.Join(testdir, "apps", "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	out, err = runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "defined twice")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), ":8080")
+}
+
+func TestOrchesWatch(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "Caddyfile"), `:8080 {
+	respond "v1"
+}
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Volume=/var/lib/orches/repo/Caddyfile:/etc/caddy/Caddyfile:z
+X-Orches-Watch=Caddyfile
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "v1")
+
+	// Only change the watched file, caddy must be restarted to pick it up
+	addAndCommit(t, filepath.Join(testdir, "Caddyfile"), `:8080 {
+	respond "v2"
+}
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "v2")
+}
+
+func TestOrchesWatchForcePush(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "Caddyfile"), `:8080 {
+	respond "v1"
+}
+`)
+	addFile(t, filepath.Join(testdir, "caddy2.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Volume=/var/lib/orches/repo/Caddyfile:/etc/caddy/Caddyfile:z
+X-Orches-Watch=Caddyfile
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "v1")
+
+	// Rewrite the history without the watched unit
+	branch := strings.TrimSpace(string(run(t, "git", "-C", testdir, "rev-parse", "--abbrev-ref", "HEAD")))
+	run(t, "git", "-C", testdir, "checkout", "--orphan", "rewritten")
+	run(t, "git", "-C", testdir, "rm", "-f", "caddy.container", "Caddyfile")
+	run(t, "git", "-C", testdir, "commit", "-m", "rewritten")
+	run(t, "git", "-C", testdir, "branch", "-M", branch)
+
+	out = runOrches(t, "sync")
+	assert.Contains(t, string(out), "Removed: [caddy.container]")
+	assert.NotContains(t, string(out), "Modified")
+
+	_, err := runUnchecked("ls", "/etc/containers/systemd/caddy.container")
+	assert.Error(t, err)
+
+	_, err = runUnchecked("systemctl", "is-active", "caddy")
+	assert.Error(t, err)
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesImplicitWatch(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "Caddyfile"), `:8080 {
+	respond "v1"
+}
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Volume=/var/lib/orches/repo/Caddyfile:/etc/caddy/Caddyfile:z
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "v1")
+
+	// The bind mounted file is watched even without X-Orches-Watch
+	addAndCommit(t, filepath.Join(testdir, "Caddyfile"), `:8080 {
+	respond "v2"
+}
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "v2")
+}
+
+func TestOrchesReformat(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	invocation := run(t, "systemctl", "show", "--value", "-p", "InvocationID", "caddy")
+
+	// Reformatting the unit must not restart it
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `# caddy serving static files
+[Container]
+Exec=/usr/bin/caddy file-server \
+  --listen :8080 \
+  --root /usr/share/caddy
+
+Image = docker.io/library/caddy:alpine
+`)
+
+	runOrches(t, "sync")
+
+	out := run(t, "systemctl", "show", "--value", "-p", "InvocationID", "caddy")
+	assert.Equal(t, string(invocation), string(out))
+}
+
+func TestOrchesDependencyCycle(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	// Introduce a cycle between caddy and caddy2
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Unit]
+After=caddy2.service
+
+[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy2.container"), `[Unit]
+After=caddy.service
+
+[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	out, err := runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "dependency cycle")
+
+	// Nothing must have been touched
+	_, err = runUnchecked("ls", "/etc/containers/systemd/caddy2.container")
+	assert.Error(t, err)
+
+	out = run(t, "systemctl", "status", "caddy")
+	assert.Contains(t, string(out), "Active: active (running)")
+}
+
+func TestOrchesRollback(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	head := run(t, "git", "-C", "/var/lib/orches/repo", "rev-parse", "HEAD")
+
+	// Break caddy, and add a container that cannot start
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy2.container"), `[Container]
+Image=localhost/orches-does-not-exist
+`)
+
+	out, err := runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "rolled back")
+
+	// The system and the repository must be back at the original commit
+	out = run(t, "git", "-C", "/var/lib/orches/repo", "rev-parse", "HEAD")
+	assert.Equal(t, string(head), string(out))
+
+	_, err = runUnchecked("ls", "/etc/containers/systemd/caddy2.container")
+	assert.Error(t, err)
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// The rolled back commit must not be deployed again
+	out, err = runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "rolled back before")
+
+	out = runOrches(t, "status")
+	assert.Contains(t, string(out), "rejected: ")
+
+	out = runOrches(t, "diff")
+	assert.Contains(t, string(out), "Refused: ")
+	assert.Contains(t, string(out), "+ caddy2.container")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// A new commit is deployed again
+	run(t, "rm", filepath.Join(testdir, "caddy2.container"))
+	commit(t, testdir)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	out = runOrches(t, "status")
+	assert.NotContains(t, string(out), "rejected: ")
+}
+
+func TestOrchesHealthCheck(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+HealthCmd=wget -q -O /dev/null http://localhost:8080
+HealthInterval=1s
+`)
+
+	runOrches(t, "--health-timeout", "30s", "init", testdir)
+
+	// A healthcheck that never passes must fail the sync, and roll it back
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+HealthCmd=wget -q -O /dev/null http://localhost:9999
+HealthInterval=1s
+`)
+
+	out, err := runUnchecked("/app/orches", "--health-timeout", "10s", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "health check failed")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), "localhost:8080")
+
+	// A container that exits right after starting must fail the sync as well
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy version
+`)
+
+	out, err = runUnchecked("/app/orches", "--health-timeout", "10s", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "health check failed")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), "localhost:8080")
+}
+
+func TestOrchesDiff(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+# Moved to 9090
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy2.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+
+	// A unit file that orches does not own makes the sync refuse, the plan must report it
+	unmanaged := `[Container]
+Image=docker.io/library/caddy:alpine
+`
+	addFile(t, "/etc/containers/systemd/caddy3.container", unmanaged)
+	addAndCommit(t, filepath.Join(testdir, "caddy3.container"), unmanaged)
+
+	out := runOrches(t, "diff")
+	assert.Contains(t, string(out), "+ caddy2.container")
+	assert.Contains(t, string(out), "~ caddy.container")
+	assert.Contains(t, string(out), "! caddy3.container")
+	// Diffs are of the files in the repository, not of their canonical form without comments
+	assert.Contains(t, string(out), "+# Moved to 9090")
+	assert.Contains(t, string(out), "+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy")
+	assert.Contains(t, string(out), "systemctl try-restart caddy.service")
+	assert.Contains(t, string(out), "systemctl start caddy2.service caddy.service")
+
+	// Nothing must have been changed
+	_, err := runUnchecked("ls", "/etc/containers/systemd/caddy2.container")
+	assert.Error(t, err)
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesOutput(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := runOrches(t, "-o", "json", "status")
+	assert.Contains(t, string(out), `"remote": `)
+	assert.Contains(t, string(out), `"ref": `)
+
+	out = runOrches(t, "-o", "yaml", "status")
+	assert.Contains(t, string(out), "remote: ")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy2.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "-o", "json", "diff")
+	assert.Contains(t, string(out), `"added": [`)
+	assert.Contains(t, string(out), `"caddy2.container"`)
+
+	out = runOrches(t, "-o", "json", "sync")
+	assert.Contains(t, string(out), `"added": [`)
+	assert.Contains(t, string(out), `"caddy2.container"`)
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "-o", "json", "sync")
+	assert.Contains(t, string(out), `"restarted": [
+    "caddy.container"
+  ]`)
+
+	// A unit that fails to start is reported with its error
+	addAndCommit(t, filepath.Join(testdir, "caddy3.container"), `[Container]
+Image=localhost/orches-does-not-exist
+`)
+
+	out, err := runUnchecked("/app/orches", "-o", "json", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), `"unitErrors": {`)
+	assert.Contains(t, string(out), `"caddy3.container": "failed to start`)
+
+	out = runOrches(t, "-o", "json", "status")
+	assert.Contains(t, string(out), `"rejected": `)
+
+	_, err = runUnchecked("/app/orches", "-o", "xml", "status")
+	assert.Error(t, err)
+}
+
+func TestOrchesStatus(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := runOrches(t, "-o", "json", "status")
+	assert.Contains(t, string(out), `"repoPath": "caddy.container"`)
+	assert.Contains(t, string(out), `"path": "/etc/containers/systemd/caddy.container"`)
+	assert.Contains(t, string(out), `"systemctlName": "caddy.service"`)
+	assert.Contains(t, string(out), `"activeState": "active"`)
+	assert.Contains(t, string(out), `"subState": "running"`)
+	assert.Contains(t, string(out), `"inSync": true`)
+
+	// Modify the installed unit behind orches' back
+	addFile(t, "/etc/containers/systemd/caddy.container", `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	out = runOrches(t, "-o", "json", "status")
+	assert.Contains(t, string(out), `"inSync": false`)
+	assert.Contains(t, string(out), "installed unit differs from the repository")
+
+	out = runOrches(t, "status")
+	assert.Contains(t, string(out), "caddy.service")
+	assert.Contains(t, string(out), "active (running)")
+}
+
+func TestOrchesReconcile(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	// Edit the installed unit by hand
+	addFile(t, "/etc/containers/systemd/caddy.container", `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	run(t, "systemctl", "daemon-reload")
+	run(t, "systemctl", "restart", "caddy")
+
+	out := run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	// Start the run process in the reconcile mode
+	syncCmd := cmd("/app/orches", "-vv", "run", "--interval", "10", "--reconcile")
+	cmd := exec.Command(syncCmd[0], syncCmd[1:]...)
+	require.NoError(t, cmd.Start())
+
+	// Wait for the first tick
+	time.Sleep(3 * time.Second)
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), ":8080")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	out = runOrches(t, "-o", "json", "status")
+	assert.Contains(t, string(out), `"inSync": true`)
+
+	// Stop the daemon
+	runOrches(t, "prune")
+	require.NoError(t, cmd.Wait())
+}
+
+func TestOrchesManifest(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "cat", "/var/lib/orches/manifest.json")
+	assert.Contains(t, string(out), `"name": "caddy.container"`)
+	assert.Contains(t, string(out), `"path": "/etc/containers/systemd/caddy.container"`)
+
+	// Lose the local checkout
+	run(t, "rm", "-rf", "/var/lib/orches/repo")
+
+	// Prune must still remove the deployed units
+	runOrches(t, "prune")
+
+	_, err := runUnchecked("ls", "/etc/containers/systemd/caddy.container")
+	assert.Error(t, err)
+
+	_, err = runUnchecked("systemctl", "is-active", "caddy")
+	assert.Error(t, err)
+
+	_, err = runUnchecked("ls", "/var/lib/orches/manifest.json")
+	assert.Error(t, err)
+}
+
+func TestOrchesAdopt(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	// A hand-made unit already exists on the host
+	run(t, "mkdir", "-p", "/etc/containers/systemd")
+	addFile(t, "/etc/containers/systemd/caddy.container", `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	run(t, "systemctl", "daemon-reload")
+	run(t, "systemctl", "start", "caddy")
+
+	// orches must refuse to overwrite it
+	out, err := runUnchecked("/app/orches", "init", testdir)
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "refusing to overwrite unmanaged unit files")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), ":9090")
+
+	out = runOrches(t, "init", "--adopt", "--yes", testdir)
+	assert.Contains(t, string(out), "-Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// A new commit adds a unit that already exists
+	addFile(t, "/etc/containers/systemd/caddy2.container", `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+	addAndCommit(t, filepath.Join(testdir, "caddy2.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+
+	out, err = runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "refusing to overwrite unmanaged unit files")
+
+	out = runOrches(t, "adopt", "--yes")
+	assert.Contains(t, string(out), "is already installed, and is identical")
+
+	out = run(t, "cat", "/var/lib/orches/manifest.json")
+	assert.Contains(t, string(out), `"name": "caddy2.container"`)
+
+	// The adopted unit was never started, it must be started like a new one
+	out = run(t, "curl", "-s", "http://localhost:8888")
+	assert.Contains(t, string(out), "Caddy")
+
+	// An existing drop-in of a new unit must not be overwritten either
+	run(t, "mkdir", "-p", "/etc/containers/systemd/web.network.d", filepath.Join(testdir, "web.network.d"))
+	addFile(t, "/etc/containers/systemd/web.network.d/10-subnet.conf", `[Network]
+Subnet=10.89.10.0/24
+`)
+	addFile(t, filepath.Join(testdir, "web.network"), `[Network]
+`)
+	addAndCommit(t, filepath.Join(testdir, "web.network.d", "10-subnet.conf"), `[Network]
+Subnet=10.89.20.0/24
+`)
+
+	out, err = runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "refusing to overwrite unmanaged unit files")
+
+	out = runOrches(t, "adopt", "--yes")
+	assert.Contains(t, string(out), "-Subnet=10.89.10.0/24")
+	assert.Contains(t, string(out), "+Subnet=10.89.20.0/24")
+
+	// Switching to a repository with an unmanaged unit must fail before pruning anything
+	run(t, "mkdir", "-p", testdir2)
+	run(t, "git", "-C", testdir2, "init")
+	unmanaged := `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`
+	addFile(t, "/etc/containers/systemd/caddy3.container", unmanaged)
+	addAndCommit(t, filepath.Join(testdir2, "caddy3.container"), unmanaged)
+
+	out, err = runUnchecked("/app/orches", "switch", testdir2)
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "refusing to switch")
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesRef(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+	run(t, "git", "-C", testdir, "tag", "v1.2.0")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	runOrches(t, "init", "--ref", "v*", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	out = runOrches(t, "status")
+	assert.Contains(t, string(out), "target: v*")
+
+	// v1.10.0 is newer than v1.2.0
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+	run(t, "git", "-C", testdir, "tag", "v1.10.0")
+	run(t, "git", "-C", testdir, "tag", "not-a-version")
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:8888")
+	assert.Contains(t, string(out), "Caddy")
+
+	// Commits after the tag are not deployed
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), ":8888")
+}
+
+func TestOrchesGoBackend(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "--git-backend", "go", "init", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	runOrches(t, "--git-backend", "go", "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	// The backend is stored in the repository, and used without the flag
+	out = run(t, "git", "-C", "/var/lib/orches/repo", "config", "orches.backend")
+	assert.Equal(t, "go", strings.TrimSpace(string(out)))
+
+	out = runOrches(t, "status")
+	assert.Contains(t, string(out), "caddy.service")
+
+	out, err := runUnchecked("/app/orches", "--git-backend", "cli", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "cloned with the go git backend")
+
+	_, err = runUnchecked("/app/orches", "--git-backend", "svn", "status")
+	assert.Error(t, err)
+
+	// Switching to the same remote changes the backend
+	runOrches(t, "--git-backend", "cli", "switch", testdir)
+
+	out = run(t, "git", "-C", "/var/lib/orches/repo", "config", "orches.backend")
+	assert.Equal(t, "cli", strings.TrimSpace(string(out)))
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesSignatures(t *testing.T) {
+	defer cleanup(t)
+	defer run(t, "rm", "-f", "/tmp/signing-key", "/tmp/signing-key.pub")
+
+	run(t, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", "/tmp/signing-key")
+	pub := run(t, "cat", "/tmp/signing-key.pub")
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+	run(t, "git", "-C", testdir, "config", "gpg.format", "ssh")
+	run(t, "git", "-C", testdir, "config", "user.signingkey", "/tmp/signing-key.pub")
+
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+	run(t, "git", "-C", testdir, "add", ".")
+	run(t, "git", "-C", testdir, "commit", "-S", "-m", "signed")
+
+	run(t, "mkdir", "-p", "/var/lib/orches/trusted-keys")
+	addFile(t, "/var/lib/orches/trusted-keys/allowed_signers", "orches@example.com "+string(pub))
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	// An unsigned commit must be refused
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	out, err := runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "not signed by a trusted key")
+
+	out = runOrches(t, "status")
+	assert.Contains(t, string(out), "refused: ")
+
+	out = runOrches(t, "diff")
+	assert.Contains(t, string(out), "Refused: ")
+	assert.Contains(t, string(out), "~ caddy.container")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), ":8080")
+
+	// Signing a new commit on top does not help, the unsigned commit is still in the range
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+	run(t, "git", "-C", testdir, "commit", "-a", "-S", "-m", "signed")
+
+	_, err = runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+
+	// Replacing the unsigned commit with a signed one is accepted
+	run(t, "git", "-C", testdir, "reset", "--hard", "HEAD~2")
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8888 --root /usr/share/caddy
+`)
+	run(t, "git", "-C", testdir, "commit", "-a", "-S", "-m", "signed")
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:8888")
+	assert.Contains(t, string(out), "Caddy")
+
+	out = runOrches(t, "status")
+	assert.NotContains(t, string(out), "refused: ")
+}
+
+func TestOrchesGoBackendRSASignature(t *testing.T) {
+	defer cleanup(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 3072)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+
+	runOrches(t, "--git-backend", "go", "init", testdir)
+
+	run(t, "mkdir", "-p", "/var/lib/orches/trusted-keys")
+	addFile(t, "/var/lib/orches/trusted-keys/allowed_signers", "orches@example.com "+string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+	run(t, "git", "-C", testdir, "add", ".")
+
+	// RSA signatures with SHA-1 are refused, although the key is trusted
+	commitSignedRSA(t, testdir, signer, ssh.KeyAlgoRSA)
+
+	out, err := runUnchecked("/app/orches", "sync")
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "unsupported SSH signature algorithm ssh-rsa")
+
+	out = run(t, "cat", "/etc/containers/systemd/caddy.container")
+	assert.Contains(t, string(out), ":8080")
+
+	// The same commit signed with SHA-512 is deployed
+	run(t, "git", "-C", testdir, "reset", "--soft", "HEAD~1")
+	commitSignedRSA(t, testdir, signer, ssh.KeyAlgoRSASHA512)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+// commitSignedRSA commits the index of the repository at dir, signed by
+// signer with the given algorithm. ssh-keygen never signs with SHA-1, so the
+// signature is made here.
+func commitSignedRSA(t *testing.T, dir string, signer ssh.Signer, algorithm string) {
+	tree := strings.TrimSpace(string(run(t, "git", "-C", dir, "write-tree")))
+	parent := strings.TrimSpace(string(run(t, "git", "-C", dir, "rev-parse", "HEAD")))
+	ident := fmt.Sprintf("orches <orches@example.com> %d +0000", time.Now().Unix())
+	header := fmt.Sprintf("tree %s\nparent %s\nauthor %s\ncommitter %s\n", tree, parent, ident, ident)
+	message := "\nsigned\n"
+
+	// The SSHSIG format of ssh-keygen, with the namespace git uses.
+	digest := sha512.Sum512([]byte(header + message))
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{"git", "", "sha512", digest[:]})...)
+
+	signature, err := signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, signed, algorithm)
+	require.NoError(t, err)
+
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, signer.PublicKey().Marshal(), "git", "", "sha512", ssh.Marshal(signature)})...)
+
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	gpgsig := "gpgsig -----BEGIN SSH SIGNATURE-----\n"
+	for len(encoded) > 0 {
+		n := min(len(encoded), 70)
+		gpgsig += " " + encoded[:n] + "\n"
+		encoded = encoded[n:]
+	}
+	gpgsig += " -----END SSH SIGNATURE-----\n"
+
+	addFile(t, "/tmp/signed-commit", header+gpgsig+message)
+	commit := strings.TrimSpace(string(run(t, "git", "-C", dir, "hash-object", "-t", "commit", "-w", "/tmp/signed-commit")))
+	run(t, "git", "-C", dir, "update-ref", "HEAD", commit)
+}
+
+func TestOrchesSymlink(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+`)
+	run(t, "mkdir", "-p", filepath.Join(testdir, "common.d"))
+	addFile(t, filepath.Join(testdir, "common.d", "10-port.conf"), `[Container]
+Exec=/usr/bin/caddy file-server --listen :8080 --root /usr/share/caddy
+`)
+	// Symlinks are followed within the repository
+	run(t, "ln", "-s", "common.d", filepath.Join(testdir, "caddy.container.d"))
+	commit(t, testdir)
+
+	runOrches(t, "init", testdir)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	addAndCommit(t, filepath.Join(testdir, "common.d", "10-port.conf"), `[Container]
+Exec=/usr/bin/caddy file-server --listen :9090 --root /usr/share/caddy
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	// The go backend follows symlinks too
+	runOrches(t, "--git-backend", "go", "switch", testdir)
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	// Trees are read from the repository, no worktrees are created
+	out = run(t, "git", "-C", "/var/lib/orches/repo", "worktree", "list")
+	assert.Equal(t, 1, strings.Count(string(out), "\n"))
+}
+
+func TestOrchesShallow(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+	run(t, "git", "-C", testdir, "config", "uploadpack.allowFilter", "true")
+
+	addAndCommit(t, filepath.Join(testdir, "README.md"), "history")
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=8080:80
+`)
+
+	runOrches(t, "init", "--depth", "1", "--filter", "blob:none", "file://"+testdir)
+
+	out := run(t, "git", "-C", "/var/lib/orches/repo", "rev-parse", "--is-shallow-repository")
+	assert.Equal(t, "true\n", string(out))
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=9090:80
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	// The deployed commit is kept when the remote is force-pushed
+	addFile(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=8888:80
+`)
+	run(t, "git", "-C", testdir, "commit", "-a", "--amend", "-m", "amend")
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:8888")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+func TestOrchesCredentials(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=8080:80
+`)
+
+	run(t, "mkdir", "-p", "/etc/orches")
+	defer runUnchecked("rm", "-rf", "/etc/orches")
+	addFile(t, "/etc/orches/token", "secret\n")
+	addFile(t, "/etc/orches/known_hosts", "")
+
+	// Only one token source can be used
+	_, err := runUnchecked("/app/orches", "init", "--token-file", "/etc/orches/token", "--token-credential", "token", testdir)
+	assert.Error(t, err)
+	_, err = runUnchecked("/app/orches", "init", "--token-file", "/etc/orches/missing", testdir)
+	assert.Error(t, err)
+	_, err = runUnchecked("ls", "/var/lib/orches/repo")
+	assert.Error(t, err)
+
+	runOrches(t, "init", "--token-file", "/etc/orches/token", "--known-hosts", "/etc/orches/known_hosts", testdir)
+
+	// Credentials are stored in the repository, and not in the global git config
+	out := run(t, "git", "-C", "/var/lib/orches/repo", "config", "--local", "orches.tokenFile")
+	assert.Equal(t, "/etc/orches/token\n", string(out))
+	_, err = runUnchecked("git", "config", "--global", "--get-regexp", "^http\\.")
+	assert.Error(t, err)
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=9090:80
+`)
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+}
+
+// gitHTTPServer serves the repositories in its first argument with git
+// http-backend, to clients that authenticate with the token in its second
+// argument.
+const gitHTTPServer = `import base64, os, subprocess, sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+root, token = sys.argv[1], sys.argv[2]
+expected = "Basic " + base64.b64encode(("x-access-token:" + token).encode()).decode()
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        self.backend()
+
+    def do_POST(self):
+        self.backend()
+
+    def backend(self):
+        if self.headers.get("Authorization") != expected:
+            self.send_response(401)
+            self.send_header("WWW-Authenticate", 'Basic realm="git"')
+            self.end_headers()
+            return
+
+        path, _, query = self.path.partition("?")
+        env = dict(os.environ,
+            GIT_PROJECT_ROOT=root,
+            GIT_HTTP_EXPORT_ALL="1",
+            REQUEST_METHOD=self.command,
+            PATH_INFO=path,
+            QUERY_STRING=query,
+            REMOTE_USER="x-access-token",
+            CONTENT_TYPE=self.headers.get("Content-Type", ""),
+            CONTENT_LENGTH=self.headers.get("Content-Length", "0"),
+            HTTP_CONTENT_ENCODING=self.headers.get("Content-Encoding", ""),
+            HTTP_GIT_PROTOCOL=self.headers.get("Git-Protocol", ""))
+        body = self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        out = subprocess.run(["git", "http-backend"], input=body, env=env, capture_output=True).stdout
+
+        head, _, content = out.partition(b"\r\n\r\n")
+        status = 200
+        headers = []
+        for line in head.decode().split("\r\n"):
+            name, _, value = line.partition(": ")
+            if name == "Status":
+                status = int(value.split()[0])
+            else:
+                headers.append((name, value))
+
+        self.send_response(status)
+        for name, value in headers:
+            self.send_header(name, value)
+        self.send_header("Content-Length", str(len(content)))
+        self.end_headers()
+        self.wfile.write(content)
+
+HTTPServer(("127.0.0.1", 8181), Handler).serve_forever()
+`
+
+func TestOrchesCredentialsHTTP(t *testing.T) {
+	defer cleanup(t)
+
+	run(t, "mkdir", "-p", testdir)
+	run(t, "git", "-C", testdir, "init")
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=8080:80
+`)
+
+	run(t, "mkdir", "-p", "/etc/orches")
+	defer runUnchecked("rm", "-rf", "/etc/orches")
+	addFile(t, "/etc/orches/token", "secret\n")
+	addFile(t, "/etc/orches/wrong-token", "wrong\n")
+	addFile(t, "/etc/orches/git-http.py", gitHTTPServer)
+
+	run(t, "systemd-run", "--unit", "orches-git-http", "python3", "/etc/orches/git-http.py", filepath.Dir(testdir), "secret")
+	defer runUnchecked("systemctl", "stop", "orches-git-http")
+	time.Sleep(1 * time.Second)
+
+	remote := "http://127.0.0.1:8181/" + filepath.Base(testdir)
+
+	// The remote refuses clients without the token
+	_, err := runUnchecked("/app/orches", "init", remote)
+	assert.Error(t, err)
+	_, err = runUnchecked("/app/orches", "init", "--token-file", "/etc/orches/wrong-token", remote)
+	assert.Error(t, err)
+	_, err = runUnchecked("ls", "/var/lib/orches/repo")
+	assert.Error(t, err)
+
+	runOrches(t, "init", "--token-file", "/etc/orches/token", remote)
+
+	out := run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=9090:80
+`)
+
+	// The token is not stored, and credential helpers of the global git
+	// config are not asked for the remote
+	_, err = runUnchecked("grep", "-r", "secret", "/var/lib/orches/repo/.git/config")
+	assert.Error(t, err)
+	run(t, "git", "config", "--global", "credential.helper", "!f() { echo username=x-access-token; echo password=wrong; }; f")
+	defer runUnchecked("git", "config", "--global", "--unset", "credential.helper")
+
+	runOrches(t, "sync")
+
+	out = run(t, "curl", "-s", "http://localhost:9090")
+	assert.Contains(t, string(out), "Caddy")
+
+	addAndCommit(t, filepath.Join(testdir, "caddy.container"), `[Container]
+Image=docker.io/library/caddy:alpine
+PublishPort=8080:80
+`)
+
+	// The go backend sends the token too
+	runOrches(t, "--git-backend", "go", "switch", "--token-file", "/etc/orches/token", remote)
+
+	out = run(t, "curl", "-s", "http://localhost:8080")
+	assert.Contains(t, string(out), "Caddy")
+}